@@ -250,8 +250,13 @@ func (c *Child) Stop() {
 	c.stopped = true
 }
 
-// State returns current state of the process
+// State returns current state of the process or nil if it has been stopped
 func (c *Child) State() *os.ProcessState {
+	c.RLock()
+	defer c.RUnlock()
+	if c.cmd == nil {
+		return nil
+	}
 	return c.cmd.ProcessState
 }
 
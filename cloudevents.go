@@ -0,0 +1,61 @@
+package floop
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/d3sw/floop/types"
+)
+
+const formatCloudEvents = "cloudevents"
+
+// validateFormat validates the payload format of a handler config
+func validateFormat(conf *types.HandlerConfig) error {
+	switch conf.Format {
+	case "", formatCloudEvents:
+		return nil
+	}
+	return fmt.Errorf("format unsupported: %s", conf.Format)
+}
+
+// newCloudEvent wraps the event in a CloudEvents envelope.  The source and subject are taken from
+// the normalized cloudevents options.  Source defaults to floop/<hostname>.
+func newCloudEvent(event *types.Event, conf *types.HandlerConfig) (*types.CloudEvent, error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"id":        event.ID,
+		"run_id":    event.RunID,
+		"seq":       event.Seq,
+		"type":      event.Type,
+		"timestamp": event.Timestamp,
+		"meta":      event.Meta,
+		"data":      jsonValue(event.Data),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ce := &types.CloudEvent{
+		SpecVersion:     types.CloudEventsSpecVersion,
+		ID:              event.ID,
+		Type:            "floop." + string(event.Type),
+		Time:            time.Unix(0, event.Timestamp).UTC().Format(time.RFC3339Nano),
+		DataContentType: "application/json",
+		Data:            data,
+		RunID:           event.RunID,
+		Sequence:        strconv.FormatUint(event.Seq, 10),
+	}
+
+	if opts, ok := conf.Options.GetOptions(formatCloudEvents); ok {
+		ce.Source, _ = opts.GetString("source")
+		ce.Subject, _ = opts.GetString("subject")
+	}
+	if ce.Source == "" {
+		hostname, _ := os.Hostname()
+		ce.Source = "floop/" + hostname
+	}
+
+	return ce, nil
+}
@@ -0,0 +1,82 @@
+package floop
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/d3sw/floop/handlers"
+	"github.com/d3sw/floop/types"
+)
+
+func Test_phaseHandler_CloudEvents(t *testing.T) {
+	conf := &types.HandlerConfig{
+		Type:   "gnatsd",
+		Format: formatCloudEvents,
+		Options: types.Options{
+			"topic": "test",
+			"cloudevents": map[interface{}]interface{}{
+				"source":  "floop/test",
+				"subject": "${Meta.refname}",
+			},
+		},
+	}
+	handler, err := newPhaseHandler(&handlers.EchoHandler{}, conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := handler.buildConfig(&types.Event{
+		ID:        "event1",
+		RunID:     "run1",
+		Seq:       3,
+		Type:      types.EventTypeCompleted,
+		Timestamp: time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC).UnixNano(),
+		Meta:      map[string]interface{}{"refname": "ref1"},
+		Data:      []byte("done"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ce map[string]interface{}
+	if err = json.Unmarshal([]byte(out.Body), &ce); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"specversion":     "1.0",
+		"source":          "floop/test",
+		"type":            "floop.completed",
+		"subject":         "ref1",
+		"time":            "2018-06-01T00:00:00Z",
+		"datacontenttype": "application/json",
+		"id":              "event1",
+		"runid":           "run1",
+		"sequence":        "3",
+	}
+	for k, v := range expected {
+		if ce[k] != v {
+			t.Errorf("%s: expected %v got %v", k, v, ce[k])
+		}
+	}
+	if data := ce["data"].(map[string]interface{}); data["data"] != "done" {
+		t.Errorf("data: %v", data)
+	}
+}
+
+func Test_phaseHandler_CloudEvents_Body(t *testing.T) {
+	conf := &types.HandlerConfig{Format: formatCloudEvents, Body: "explicit"}
+	handler, err := newPhaseHandler(&handlers.EchoHandler{}, conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := handler.buildConfig(&types.Event{Type: types.EventTypeBegin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Body != "explicit" || out.CloudEvent != nil {
+		t.Fatalf("explicit body should not be wrapped: %s", out.Body)
+	}
+}
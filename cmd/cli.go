@@ -19,6 +19,7 @@ type CLI struct {
 	isHelp    bool
 	isVersion bool
 	debug     bool
+	isWorker  bool // run jobs received over nats
 
 	Exec []string               // child process command and args
 	Meta map[string]interface{} // context data from command line
@@ -63,6 +64,8 @@ func NewCLI(version string, args []string) (cli *CLI, err error) {
 			}
 			return
 
+		case "worker":
+			cli.isWorker = true
 		case "-c":
 			i++
 			cli.ConfigFile = args[i]
@@ -90,6 +93,7 @@ func NewCLI(version string, args []string) (cli *CLI, err error) {
 func (cli *CLI) Usage() {
 	fmt.Printf(`
 Usage: floop [-c <config_file>] [key=value ...] -exec <command> [args]
+       floop worker [-c <config_file>] [-exec <command> [args]]
 
 floop is a tool to add lifecycle event handlers to any arbitrary process
 
@@ -108,6 +112,9 @@ func (cli *CLI) Run() (int, error) {
 		log.SetFlags(log.LstdFlags | log.Lshortfile | log.Lmicroseconds)
 	}
 
+	if cli.isWorker {
+		return cli.runWorker()
+	}
 	return cli.run()
 }
 
@@ -142,3 +149,26 @@ func (cli *CLI) run() (int, error) {
 	exitCode = loop.Wait()
 	return exitCode, nil
 }
+
+// runWorker runs floop as a worker taking jobs from nats until signaled
+func (cli *CLI) runWorker() (int, error) {
+	conf, err := floop.LoadConfig(cli.ConfigFile)
+	if err != nil {
+		return -1, err
+	}
+
+	// Override cli command and args
+	if cmd := cli.Command(); cmd != "" {
+		conf.Command = cmd
+		conf.Args = cli.Args()
+	}
+
+	worker, err := floop.NewWorker(conf)
+	if err != nil {
+		return -1, err
+	}
+	if err = worker.Run(); err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
@@ -1,7 +1,9 @@
 package floop
 
 import (
+	"fmt"
 	"io/ioutil"
+	"path/filepath"
 
 	yaml "gopkg.in/yaml.v2"
 
@@ -18,6 +20,19 @@ type Config struct {
 	ResolverPort   int      `yml:"resolverport"`
 	Handlers       map[types.EventType][]*types.HandlerConfig
 	ReadFromStderr bool `yml:"stderr"`
+	// Groups multiple lines of output into a single progress event
+	Record *types.RecordConfig
+	// Output sanitization applied before progress callbacks and result capture
+	Sanitize types.SanitizeConfig
+	// Directory of secret files available to templates as ${Secret.<filename>}
+	SecretsDir string
+	// Template files shared by all gotemplate handlers by file name.  Paths are relative to the
+	// config file
+	Partials []string
+	// Remote control of the child over nats
+	Control *types.ControlConfig
+	// Run the command for each job received over nats.  Used by floop worker
+	Worker *types.WorkerConfig
 }
 
 // HasMeta checks if the input meta has the required metadata keys
@@ -36,6 +51,7 @@ func DefaultConfig() *Config {
 		Quiet:         false,
 		ResolverHosts: []string{dResolverHost},
 		ResolverPort:  dResolverPort,
+		SecretsDir:    dSecretsDir,
 		Handlers:      make(map[types.EventType][]*types.HandlerConfig),
 	}
 }
@@ -48,6 +64,55 @@ func LoadConfig(filename string) (*Config, error) {
 	}
 
 	var conf Config
-	err = yaml.Unmarshal(b, &conf)
+	if err = yaml.Unmarshal(b, &conf); err != nil {
+		return &conf, err
+	}
+
+	err = conf.loadTemplates(filepath.Dir(filename))
 	return &conf, err
 }
+
+// loadTemplates loads body files and partials relative to dir and validates all handler
+// templates.
+func (conf *Config) loadTemplates(dir string) error {
+	partials := make(map[string]string, len(conf.Partials))
+	for _, p := range conf.Partials {
+		b, err := ioutil.ReadFile(resolvePath(dir, p))
+		if err != nil {
+			return err
+		}
+		partials[filepath.Base(p)] = string(b)
+	}
+
+	for eventType, configs := range conf.Handlers {
+		for _, hc := range configs {
+			if hc.BodyFile != "" {
+				if hc.Body != "" {
+					return fmt.Errorf("phase=%s handler=%s body and body_file are exclusive", eventType, hc.Type)
+				}
+				b, err := ioutil.ReadFile(resolvePath(dir, hc.BodyFile))
+				if err != nil {
+					return err
+				}
+				hc.Body = string(b)
+			}
+			if len(partials) > 0 {
+				hc.Partials = partials
+			}
+
+			// Parse to report template errors on load
+			if _, err := newPhaseHandler(nil, hc, nil); err != nil {
+				return fmt.Errorf("phase=%s handler=%s %v", eventType, hc.Type, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
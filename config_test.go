@@ -1,6 +1,12 @@
 package floop
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/d3sw/floop/handlers"
+	"github.com/d3sw/floop/types"
+)
 
 func Test_Http_Config(t *testing.T) {
 	conf, err := LoadConfig("./test-data/http.yml")
@@ -16,6 +22,64 @@ func Test_Gnatsd_Config(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	// Optional examples are commented out
+	if conf.Record != nil || conf.Control != nil {
+		t.Fatalf("record=%+v control=%+v", conf.Record, conf.Control)
+	}
+
+	t.Logf("%+v\n", conf)
+}
+
+func Test_JetStream_Config(t *testing.T) {
+	conf, err := LoadConfig("./test-data/jetstream.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	t.Logf("%+v\n", conf)
 }
+
+func Test_Worker_Config(t *testing.T) {
+	conf, err := LoadConfig("./test-data/worker.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := conf.Worker
+	if w == nil || w.Topic != "floop.jobs.ffmpeg" || w.Concurrency != 4 || !w.JetStream || w.AckWait != 30 {
+		t.Fatalf("%+v", w)
+	}
+	if err = w.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_Template_Config(t *testing.T) {
+	conf, err := LoadConfig("./test-data/http-templates.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc := conf.Handlers[types.EventTypeFailed][0]
+	handler, err := newPhaseHandler(&handlers.EchoHandler{}, hc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := handler.buildConfig(&types.Event{
+		Type: types.EventTypeFailed,
+		Meta: map[string]interface{}{"workflowInstanceId": "wf1", "taskId": "task1"},
+		Data: &types.ChildResult{Code: 2, Stderr: []byte(`no such file "in.mp4"`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body map[string]interface{}
+	if err = json.Unmarshal([]byte(out.Body), &body); err != nil {
+		t.Fatalf("invalid json: %v\n%s", err, out.Body)
+	}
+	if body["taskId"] != "task1" || body["reasonForIncompletion"] != `no such file "in.mp4"` {
+		t.Fatalf("body: %v", body)
+	}
+}
@@ -0,0 +1,185 @@
+package floop
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/d3sw/floop/handlers"
+	"github.com/d3sw/floop/types"
+)
+
+// Control commands
+const (
+	controlCancel = "cancel"
+	controlSignal = "signal"
+	controlReload = "reload"
+	controlStatus = "status"
+)
+
+// controller receives commands for the child over nats.  Requests are replied to with the status
+// or the result of the command.
+type controller struct {
+	floop *Floop
+	topic handlerTemplate
+
+	conn   *nats.Conn
+	sub    *nats.Subscription
+	shared bool // the connection is owned by the controller this run was created from
+}
+
+// controlStatusReply is the reply to the status command
+type controlStatusReply struct {
+	RunID    string          `json:"run_id"`
+	Phase    types.EventType `json:"phase"`
+	PID      int             `json:"pid"`
+	Progress string          `json:"progress,omitempty"`
+}
+
+// newController connects to the control channel.  The floop is set by the caller.
+func newController(conf *types.ControlConfig, vars *templateVars) (*controller, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	topic, err := parseTemplate(&types.HandlerConfig{Engine: conf.Engine}, conf.Topic)
+	if err != nil {
+		return nil, fmt.Errorf("control topic template: %v", err)
+	}
+
+	opts, err := renderOptions(&types.HandlerConfig{Engine: conf.Engine}, conf.Options, nil, vars)
+	if err != nil {
+		return nil, fmt.Errorf("control options: %v", err)
+	}
+	conn, err := handlers.NatsConnect(conf.URI, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &controller{topic: topic, conn: conn}, nil
+}
+
+// newRun returns a controller for another run on the same connection
+func (c *controller) newRun(floop *Floop) *controller {
+	return &controller{floop: floop, topic: c.topic, conn: c.conn, shared: true}
+}
+
+// Start subscribes to the topic rendered with the meta
+func (c *controller) Start(meta map[string]interface{}) error {
+	lc := c.floop.lifecycle
+	topic, err := c.topic.Execute(newTemplateData(&types.Event{RunID: lc.RunID(), Meta: meta}, lc.vars))
+	if err != nil {
+		return err
+	}
+
+	if c.sub, err = c.conn.Subscribe(topic, c.handle); err != nil {
+		return err
+	}
+	log.Printf("[INFO] (floop) listening for control commands topic=%s", topic)
+	return nil
+}
+
+func (c *controller) handle(msg *nats.Msg) {
+	cmd := strings.TrimSpace(string(msg.Data))
+	log.Printf("[INFO] (floop) control command %q", cmd)
+
+	// Reply before canceling as Wait closes the connection once canceled
+	if strings.ToLower(cmd) == controlCancel {
+		c.respond(msg, nil, nil)
+		c.floop.Cancel()
+		return
+	}
+
+	reply, err := c.command(cmd)
+	if err != nil {
+		log.Printf("[ERROR] (floop) control command %q: %v", cmd, err)
+	}
+	c.respond(msg, reply, err)
+}
+
+// command runs the command returning the reply if any
+func (c *controller) command(cmd string) (interface{}, error) {
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		return nil, errors.New("command required")
+	}
+
+	switch strings.ToLower(args[0]) {
+	case controlCancel:
+		c.floop.Cancel()
+		return nil, nil
+
+	case controlSignal:
+		if len(args) != 2 {
+			return nil, errors.New("usage: signal <name>")
+		}
+		sig, err := parseSignal(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return nil, c.floop.proc.Signal(sig)
+
+	case controlReload:
+		// Without a reload signal the child would be restarted which is not supported
+		if c.floop.procInput.ReloadSignal == nil {
+			return nil, errors.New("reload requires reload_signal")
+		}
+		return nil, c.floop.proc.Reload()
+
+	case controlStatus:
+		phase, progress := c.floop.lifecycle.Status()
+		return &controlStatusReply{
+			RunID:    c.floop.lifecycle.RunID(),
+			Phase:    phase,
+			PID:      c.floop.proc.Pid(),
+			Progress: string(progress),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown command: %s", args[0])
+}
+
+func (c *controller) respond(msg *nats.Msg, reply interface{}, err error) {
+	if msg.Reply == "" {
+		return
+	}
+
+	switch {
+	case err != nil:
+		reply = map[string]interface{}{"error": err.Error()}
+	case reply == nil:
+		reply = map[string]interface{}{"ok": true}
+	}
+
+	b, err := json.Marshal(reply)
+	if err == nil {
+		err = msg.Respond(b)
+	}
+	if err != nil {
+		log.Printf("[ERROR] (floop) control reply: %v", err)
+	}
+}
+
+// Close unsubscribes and closes the connection unless it is shared
+func (c *controller) Close() {
+	if c.sub != nil {
+		c.sub.Unsubscribe()
+	}
+	if !c.shared {
+		c.conn.Close()
+	}
+}
+
+// parseSignal returns the signal by name with or without the SIG prefix e.g. TERM or SIGTERM
+func parseSignal(name string) (os.Signal, error) {
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return nil, fmt.Errorf("signal unsupported: %s", name)
+	}
+	return sig, nil
+}
@@ -0,0 +1,101 @@
+package floop
+
+import (
+	"testing"
+	"time"
+
+	"github.com/d3sw/floop/child"
+	"github.com/d3sw/floop/types"
+)
+
+func Test_controller_command(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Command = "sleep"
+	conf.Args = []string{"30"}
+	conf.Quiet = true
+
+	flp, err := New(conf, &child.NewInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &testHandler{}
+	if err = flp.lifecycle.register(types.EventTypeCanceled, h, &types.HandlerConfig{Type: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = flp.Start(map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &controller{floop: flp}
+
+	reply, err := c.command("status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := reply.(*controlStatusReply)
+	if status.PID == 0 || status.Phase != types.EventTypeBegin || status.RunID != flp.lifecycle.RunID() {
+		t.Fatalf("status: %+v", status)
+	}
+
+	// Reload requires reload_signal
+	for _, cmd := range []string{"", "signal", "signal BOGUS", "restart", "reload"} {
+		if _, err = c.command(cmd); err == nil {
+			t.Fatalf("%q should fail", cmd)
+		}
+	}
+	if _, err = c.command("signal SIGCONT"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.command("cancel"); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan int, 1)
+	go func() { done <- flp.Wait() }()
+	select {
+	case code := <-done:
+		if code != exitCodeCanceled {
+			t.Fatalf("exit code %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait did not return after cancel")
+	}
+
+	if len(h.events) != 1 {
+		t.Fatalf("canceled events: %d", len(h.events))
+	}
+}
+
+func Test_Floop_CancelAfterExit(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Command = "sh"
+	conf.Args = []string{"-c", "exit 3"}
+	conf.Quiet = true
+
+	flp, err := New(conf, &child.NewInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed, canceled := &testHandler{}, &testHandler{}
+	if err = flp.lifecycle.register(types.EventTypeFailed, failed, &types.HandlerConfig{Type: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = flp.lifecycle.register(types.EventTypeCanceled, canceled, &types.HandlerConfig{Type: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = flp.Start(map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The child has exited by the time the cancel arrives so it keeps its exit code
+	time.Sleep(200 * time.Millisecond)
+	flp.Cancel()
+
+	if code := flp.Wait(); code != 3 {
+		t.Fatalf("exit code %d", code)
+	}
+	if len(failed.events) != 1 || len(canceled.events) != 0 {
+		t.Fatalf("failed=%d canceled=%d", len(failed.events), len(canceled.events))
+	}
+}
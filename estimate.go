@@ -0,0 +1,167 @@
+package floop
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/d3sw/floop/types"
+)
+
+const defaultEstimateWindow = 5
+
+type estimateSample struct {
+	timestamp int64 // unix nano
+	current   float64
+}
+
+// estimator adds percent, rate and eta_seconds to progress event data.  The rate is a moving
+// average over the last window samples.
+type estimator struct {
+	conf *types.EstimateConfig
+
+	mtx     sync.Mutex
+	samples []estimateSample
+}
+
+func newEstimator(conf *types.EstimateConfig) (*estimator, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return &estimator{conf: conf}, nil
+}
+
+// Apply updates the event data in place.  Events without the configured values are left as is.
+func (est *estimator) Apply(event *types.Event) {
+	data := estimateData(event.Data)
+	if data == nil {
+		return
+	}
+
+	current, total, ok := est.values(data, event.Meta)
+	if !ok {
+		return
+	}
+
+	rate := est.addSample(event.Timestamp, current)
+
+	if total > 0 {
+		data["percent"] = round(math.Min(current/total*100, 100))
+	}
+	data["rate"] = round(rate)
+	if rate > 0 && total > current {
+		data["eta_seconds"] = round((total - current) / rate)
+	}
+
+	event.Data = data
+}
+
+func (est *estimator) values(data, meta map[string]interface{}) (current, total float64, ok bool) {
+	if est.conf.Ratio != "" {
+		s, found := data[est.conf.Ratio]
+		if !found {
+			return
+		}
+		arr := strings.SplitN(toString(s), "/", 2)
+		if len(arr) != 2 {
+			return
+		}
+		if current, ok = parseNumber(arr[0]); !ok {
+			return
+		}
+		total, ok = parseNumber(arr[1])
+		return
+	}
+
+	v, found := data[est.conf.Current]
+	if !found {
+		return
+	}
+	if current, ok = parseNumber(v); !ok {
+		return
+	}
+
+	if v, found = data[est.conf.Total]; !found {
+		if v, found = meta[est.conf.Total]; !found {
+			v = est.conf.Total
+		}
+	}
+	total, ok = parseNumber(v)
+	return
+}
+
+// addSample records the sample and returns the per second rate over the window
+func (est *estimator) addSample(timestamp int64, current float64) float64 {
+	window := est.conf.Window
+	if window == 0 {
+		window = defaultEstimateWindow
+	}
+
+	est.mtx.Lock()
+	defer est.mtx.Unlock()
+
+	// Restart when the value goes backwards e.g. a new pass
+	if l := len(est.samples); l > 0 && current < est.samples[l-1].current {
+		est.samples = est.samples[:0]
+	}
+
+	est.samples = append(est.samples, estimateSample{timestamp: timestamp, current: current})
+	if len(est.samples) > window {
+		est.samples = est.samples[len(est.samples)-window:]
+	}
+
+	first, last := est.samples[0], est.samples[len(est.samples)-1]
+	elapsed := float64(last.timestamp-first.timestamp) / 1e9
+	if elapsed <= 0 {
+		return 0
+	}
+	return (last.current - first.current) / elapsed
+}
+
+// estimateData returns the transformed data as a map or nil if it is not a map
+func estimateData(data interface{}) map[string]interface{} {
+	switch d := data.(type) {
+	case map[string]interface{}:
+		return d
+	case map[string]string:
+		out := make(map[string]interface{}, len(d)+3)
+		for k, v := range d {
+			out[k] = v
+		}
+		return out
+	}
+	return nil
+}
+
+func parseNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+
+	f, err := strconv.ParseFloat(strings.TrimSpace(toString(v)), 64)
+	return f, err == nil
+}
+
+func toString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case []byte:
+		return string(s)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// round rounds to 2 decimal places
+func round(f float64) float64 {
+	return math.Round(f*100) / 100
+}
@@ -0,0 +1,63 @@
+package floop
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/d3sw/floop/types"
+)
+
+func Test_Estimator(t *testing.T) {
+	est, err := newEstimator(&types.EstimateConfig{Current: "frame", Total: "frames", Window: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().UnixNano()
+	var event *types.Event
+	for i := 0; i < 4; i++ {
+		event = &types.Event{
+			Type:      types.EventTypeProgress,
+			Timestamp: start + int64(i)*int64(time.Second),
+			Meta:      map[string]interface{}{"frames": "100"},
+			Data:      map[string]string{"frame": strconv.Itoa(i * 2)},
+		}
+		est.Apply(event)
+	}
+
+	data := event.Data.(map[string]interface{})
+	if data["percent"] != 6.0 {
+		t.Fatalf("percent: %v", data["percent"])
+	}
+	if data["rate"] != 2.0 {
+		t.Fatalf("rate: %v", data["rate"])
+	}
+	if data["eta_seconds"] != 47.0 {
+		t.Fatalf("eta: %v", data["eta_seconds"])
+	}
+}
+
+func Test_Estimator_Ratio(t *testing.T) {
+	est, err := newEstimator(&types.EstimateConfig{Ratio: "progress"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := &types.Event{Data: map[string]interface{}{"progress": "25/200"}}
+	est.Apply(event)
+
+	data := event.Data.(map[string]interface{})
+	if data["percent"] != 12.5 {
+		t.Fatalf("percent: %v", data["percent"])
+	}
+	if _, ok := data["eta_seconds"]; ok {
+		t.Fatal("eta should not be set with a single sample")
+	}
+}
+
+func Test_Estimator_Invalid(t *testing.T) {
+	if _, err := newEstimator(&types.EstimateConfig{Current: "frame"}); err == nil {
+		t.Fatal("should fail without total")
+	}
+}
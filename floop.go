@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 
 	"strings"
@@ -14,6 +15,13 @@ import (
 	"github.com/d3sw/floop/types"
 )
 
+// envRunID is the environment variable exporting the run id to the child
+const envRunID = "FLOOP_RUN_ID"
+
+// exitCodeCanceled is returned by Wait when the child is canceled over the control channel.  It is
+// the code of a process killed by SIGKILL.
+const exitCodeCanceled = 137
+
 // Floop is the core interface that manages the process lifecycle and handlers
 type Floop struct {
 	lifecycle *Lifecycle
@@ -21,8 +29,16 @@ type Floop struct {
 	bufOut *BufferedWriter // writer to manage progress
 	bufErr *BufferedWriter // writer to manage progress
 
+	records []*recordAssembler // multi-line record assemblers if configured
+
 	procInput *child.NewInput
 	proc      *child.Child
+
+	control    *controller   // remote control channel if configured
+	canceled   chan struct{} // closed when the child is canceled
+	cancelOnce sync.Once
+
+	done chan struct{} // closed once the run is over to stop listening for signals
 }
 
 // New instantiates a new instance of floop.
@@ -31,21 +47,52 @@ func New(conf *Config, input *child.NewInput) (*Floop, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newFloop(conf, lifecycle, nil, input)
+}
+
+// newFloop sets up a run of the command.  Runs created from a shared lifecycle and control channel
+// reuse their connections.
+func newFloop(conf *Config, lifecycle *Lifecycle, control *controller, input *child.NewInput) (*Floop, error) {
+	flp := &Floop{lifecycle: lifecycle, canceled: make(chan struct{}), done: make(chan struct{})}
 
+	outCallbackWriter, err := flp.progressCallback(conf)
+	if err != nil {
+		return nil, err
+	}
 	var errCallbackWriter func([]byte)
 	if conf.ReadFromStderr {
-		errCallbackWriter = lifecycle.Progress
+		if errCallbackWriter, err = flp.progressCallback(conf); err != nil {
+			return nil, err
+		}
+	}
+	flp.bufOut = NewBufferedWriter(outCallbackWriter, true)
+	flp.bufErr = NewBufferedWriter(errCallbackWriter, true)
+
+	if flp.bufOut.sanitizer, err = newSanitizer(conf.Sanitize.Stdout); err != nil {
+		return nil, err
 	}
-	flp := &Floop{
-		lifecycle: lifecycle,
-		bufOut:    NewBufferedWriter(lifecycle.Progress, true),
-		bufErr:    NewBufferedWriter(errCallbackWriter, true),
+	if flp.bufErr.sanitizer, err = newSanitizer(conf.Sanitize.Stderr); err != nil {
+		return nil, err
 	}
 
 	input.Command = conf.Command
 	input.Args = conf.Args
 
-	input.Stdin = os.Stdin
+	// Export the run id so the child's own logs can be correlated
+	if input.Env == nil {
+		input.Env = os.Environ()
+	}
+	input.Env = append(input.Env, envRunID+"="+lifecycle.RunID())
+
+	if conf.Control != nil && conf.Control.ReloadSignal != "" && input.ReloadSignal == nil {
+		if input.ReloadSignal, err = parseSignal(conf.Control.ReloadSignal); err != nil {
+			return nil, err
+		}
+	}
+
+	if input.Stdin == nil {
+		input.Stdin = os.Stdin
+	}
 	if conf.Quiet {
 		input.Stdout = flp.bufOut
 		input.Stderr = flp.bufErr
@@ -55,16 +102,51 @@ func New(conf *Config, input *child.NewInput) (*Floop, error) {
 	}
 
 	flp.procInput = input
-	flp.proc, err = child.New(flp.procInput)
+	if flp.proc, err = child.New(flp.procInput); err != nil {
+		return flp, err
+	}
+
+	if control != nil {
+		flp.control = control.newRun(flp)
+	} else if conf.Control != nil {
+		if flp.control, err = newController(conf.Control, lifecycle.vars); err != nil {
+			return flp, err
+		}
+		flp.control.floop = flp
+	}
+
 	go flp.listenSignals(flp.proc.Signal)
 
-	return flp, err
+	return flp, nil
+}
+
+// progressCallback returns the progress callback for an output stream.  Each stream gets its own
+// record assembler if one is configured.
+func (floop *Floop) progressCallback(conf *Config) (func([]byte), error) {
+	if conf.Record == nil {
+		return floop.lifecycle.Progress, nil
+	}
+
+	ra, err := newRecordAssembler(conf.Record, floop.lifecycle.Progress)
+	if err != nil {
+		return nil, err
+	}
+	floop.records = append(floop.records, ra)
+
+	return ra.Write, nil
 }
 
 func (floop *Floop) listenSignals(sigProcesser func(os.Signal) error) {
 	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, syscall.SIGTERM, syscall.SIGINT)
-	sig := <-signalChannel
+	defer signal.Stop(signalChannel)
+
+	var sig os.Signal
+	select {
+	case sig = <-signalChannel:
+	case <-floop.done:
+		return
+	}
 	log.Printf("[INFO] (floop) got \"%s\" signal\n", sig)
 	if err := sigProcesser(sig); err != nil {
 		log.Printf("[ERR] (floop) calling signal [%+v] to child: %s\n", sig, err.Error())
@@ -79,15 +161,66 @@ func (floop *Floop) Start(meta map[string]interface{}) error {
 		Meta:    meta,
 	}
 
+	// Close handlers on failure as Wait will not be called to publish pending events
 	if err := floop.lifecycle.Begin(ctx); err != nil {
+		floop.close()
 		return err
 	}
-	return floop.proc.Start()
+	if err := floop.proc.Start(); err != nil {
+		floop.close()
+		return err
+	}
+
+	if floop.control != nil {
+		if err := floop.control.Start(meta); err != nil {
+			floop.proc.Stop()
+			floop.close()
+			return err
+		}
+	}
+	return nil
+}
+
+// Cancel stops the child process.  Wait returns with exitCodeCanceled and the canceled phase is
+// called unless the child had already exited in which case its own exit code is kept.
+func (floop *Floop) Cancel() {
+	floop.cancelOnce.Do(func() {
+		floop.proc.Stop()
+		close(floop.canceled)
+	})
+}
+
+// close closes the lifecycle handlers and the control channel
+func (floop *Floop) close() {
+	close(floop.done)
+	floop.lifecycle.Close()
+	if floop.control != nil {
+		floop.control.Close()
+	}
 }
 
 // Wait waits for the child process to exit and calls the end phase of the lifecycle
 func (floop *Floop) Wait() int {
-	code := <-floop.proc.ExitCh()
+	// A stopped child does not send its exit code so a code means it exited on its own even if a
+	// cancel followed
+	var code int
+	canceled := false
+	select {
+	case code = <-floop.proc.ExitCh():
+	case <-floop.canceled:
+		select {
+		case code = <-floop.proc.ExitCh():
+		default:
+			code, canceled = exitCodeCanceled, true
+		}
+	}
+
+	// Issue any partially written lines and records before the final phase
+	floop.bufOut.Flush()
+	floop.bufErr.Flush()
+	for _, ra := range floop.records {
+		ra.Flush()
+	}
 
 	result := &types.ChildResult{
 		Code:   code,
@@ -95,9 +228,13 @@ func (floop *Floop) Wait() int {
 		Stderr: bytes.TrimRight(floop.bufErr.Bytes(), "\n"),
 	}
 
-	if code != 0 {
-		state := floop.proc.State().String()
-		if strings.Contains(state, os.Interrupt.String()) || strings.Contains(state, os.Kill.String()) {
+	if canceled {
+		floop.lifecycle.Canceled(result)
+	} else if code != 0 {
+		// The state is nil if a cancel arrived after the child exited
+		state := floop.proc.State()
+		if state != nil && (strings.Contains(state.String(), os.Interrupt.String()) ||
+			strings.Contains(state.String(), os.Kill.String())) {
 			floop.lifecycle.Canceled(result)
 		} else {
 			floop.lifecycle.Failed(result)
@@ -106,7 +243,7 @@ func (floop *Floop) Wait() int {
 		floop.lifecycle.Completed(result)
 	}
 
-	floop.lifecycle.Close()
+	floop.close()
 
 	return code
 }
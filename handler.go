@@ -1,8 +1,10 @@
 package floop
 
 import (
+	"encoding/json"
+	"fmt"
+
 	"github.com/d3sw/floop/types"
-	"github.com/persephony/shml"
 )
 
 // Handler represents the event handler interface.
@@ -13,39 +15,247 @@ type Handler interface {
 	CloseConnection() error
 }
 
+// Flusher is implemented by handlers that buffer events.  Progress handlers are flushed before the
+// terminal phases so buffered events are delivered first.
+type Flusher interface {
+	Flush() error
+}
+
 // phaseHandler is the internal handler wrapping the config and handler interfaces
 type phaseHandler struct {
-	conf *types.HandlerConfig
+	conf      *types.HandlerConfig
+	estimator *estimator
+	vars      *templateVars
 	Handler
+
+	// Templates parsed once at load time
+	uri     handlerTemplate
+	body    handlerTemplate
+	options interface{} // options with string values replaced by templates
+}
+
+// newPhaseHandler wraps the handler parsing all templates in the config.  Syntax errors are
+// returned here rather than on the first event.
+func newPhaseHandler(h Handler, conf *types.HandlerConfig, vars *templateVars) (*phaseHandler, error) {
+	handler := &phaseHandler{Handler: h, conf: conf, vars: vars}
+
+	if err := validateFormat(conf); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if handler.body, err = parseTemplate(conf, conf.Body); err != nil {
+		return nil, fmt.Errorf("body template: %v", err)
+	}
+	if conf.URI != "" {
+		if handler.uri, err = parseTemplate(conf, conf.URI); err != nil {
+			return nil, fmt.Errorf("uri template: %v", err)
+		}
+	}
+	if len(conf.Options) > 0 {
+		if handler.options, err = compileValue(conf, conf.Options); err != nil {
+			return nil, fmt.Errorf("options template: %v", err)
+		}
+	}
+
+	if conf.Estimate != nil {
+		if handler.estimator, err = newEstimator(conf.Estimate); err != nil {
+			return nil, err
+		}
+	}
+
+	return handler, nil
+}
+
+// newRun returns a copy of the handler for another run.  The estimator is per run.
+func (handler *phaseHandler) newRun() *phaseHandler {
+	run := *handler
+	if handler.estimator != nil {
+		run.estimator = &estimator{conf: handler.estimator.conf}
+	}
+	return &run
 }
 
 func (handler *phaseHandler) buildConfig(event *types.Event) (*types.HandlerConfig, error) {
 	// Clone existing config
 	conf := handler.conf.Clone()
+	data := newTemplateData(event, handler.vars)
 
 	// Interpolate Body
-	bodyTmpl := shml.New()
-	bodyTmpl.Parse([]byte(conf.Body))
-	out, err := bodyTmpl.Execute(event)
-	if err != nil {
+	var err error
+	if conf.Body, err = handler.body.Execute(data); err != nil {
 		return nil, err
 	}
-	conf.Body = string(out)
+
+	// Interpolate Options
+	if handler.options != nil {
+		opts, err := executeValue(handler.options, data)
+		if err != nil {
+			return nil, err
+		}
+		conf.Options = opts.(types.Options)
+	}
+
+	// Wrap the event in an envelope if no body is given
+	if conf.Format == formatCloudEvents && handler.conf.Body == "" {
+		if conf.CloudEvent, err = newCloudEvent(event, conf); err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(conf.CloudEvent)
+		if err != nil {
+			return nil, err
+		}
+		conf.Body = string(b)
+	}
 
 	// Interpolate URI
-	if handler.conf.URI == "" {
+	if handler.uri == nil {
 		return conf, nil
 	}
-	uriTmpl := shml.New()
-	uriTmpl.Parse([]byte(handler.conf.URI))
-	if out, err = uriTmpl.Execute(event); err != nil {
+	if conf.URI, err = handler.uri.Execute(data); err != nil {
 		return nil, err
 	}
-	conf.URI = string(out)
 
 	return conf, nil
 }
 
+// compileValue parses all string values as templates recursing into maps and lists.  The
+// returned value has the same shape as the input.
+func compileValue(conf *types.HandlerConfig, v interface{}) (interface{}, error) {
+	var err error
+
+	switch val := v.(type) {
+	case string:
+		return parseTemplate(conf, val)
+
+	case types.Options:
+		out := make(types.Options, len(val))
+		for k, item := range val {
+			if out[k], err = compileValue(conf, item); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			if out[k], err = compileValue(conf, item); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+
+	case map[interface{}]interface{}:
+		out := make(map[interface{}]interface{}, len(val))
+		for k, item := range val {
+			if out[k], err = compileValue(conf, item); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			if out[i], err = compileValue(conf, item); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+
+	return v, nil
+}
+
+// initOptionKeys are the handler options read by Init such as connection credentials and tls.
+// Init has no event so they may only reference Env and Secret.
+var initOptionKeys = []string{"user", "password", "token", "nkey_seed", "creds", "tls", "proxy", "timeout",
+	"servers", "name"}
+
+// renderOptions returns a copy of the options with the values of the keys rendered with only Env
+// and Secret available.  All keys are rendered if keys is nil.
+func renderOptions(conf *types.HandlerConfig, opts types.Options, keys []string, vars *templateVars) (types.Options, error) {
+	if len(opts) == 0 {
+		return opts, nil
+	}
+
+	out := make(types.Options, len(opts))
+	for k, v := range opts {
+		out[k] = v
+	}
+	if keys == nil {
+		for k := range opts {
+			keys = append(keys, k)
+		}
+	}
+
+	data := newTemplateData(&types.Event{}, vars)
+	for _, k := range keys {
+		v, ok := opts[k]
+		if !ok {
+			continue
+		}
+		compiled, err := compileValue(conf, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s template: %v", k, err)
+		}
+		if out[k], err = executeValue(compiled, data); err != nil {
+			return nil, fmt.Errorf("%s template: %v", k, err)
+		}
+	}
+	return out, nil
+}
+
+// executeValue executes all templates in a value returned by compileValue.  A copy is returned
+// leaving the compiled value untouched.
+func executeValue(v interface{}, data *templateData) (interface{}, error) {
+	var err error
+
+	switch val := v.(type) {
+	case handlerTemplate:
+		return val.Execute(data)
+
+	case types.Options:
+		out := make(types.Options, len(val))
+		for k, item := range val {
+			if out[k], err = executeValue(item, data); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			if out[k], err = executeValue(item, data); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+
+	case map[interface{}]interface{}:
+		out := make(map[interface{}]interface{}, len(val))
+		for k, item := range val {
+			if out[k], err = executeValue(item, data); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			if out[i], err = executeValue(item, data); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+
+	return v, nil
+}
+
 func (handler *phaseHandler) Handle(event *types.Event) (map[string]interface{}, error) {
 	// Apply transform to the event data before calling the handler.  It is only applied if the
 	// data is a byte slice.
@@ -64,6 +274,12 @@ func (handler *phaseHandler) Handle(event *types.Event) (map[string]interface{},
 		}
 
 	}
+
+	// Add percent and eta to the transformed progress data
+	if handler.estimator != nil && event.Type == types.EventTypeProgress {
+		handler.estimator.Apply(event)
+	}
+
 	// Build a normalized config to pass to the handler
 	conf, err := handler.buildConfig(event)
 	if err != nil {
@@ -0,0 +1,96 @@
+package floop
+
+import (
+	"os"
+	"testing"
+
+	"github.com/d3sw/floop/handlers"
+	"github.com/d3sw/floop/types"
+)
+
+func Test_phaseHandler_buildConfig_Options(t *testing.T) {
+	conf := &types.HandlerConfig{
+		Type: "gnatsd",
+		URI:  "nats://127.0.0.1:4222",
+		Options: types.Options{
+			"topic":   "jobs.${Meta.refname}.progress",
+			"retries": 3,
+			"headers": map[interface{}]interface{}{
+				"X-Correlation-Id": "${Meta.correlation}",
+			},
+			"servers": []interface{}{"nats://${Meta.host}:4222"},
+		},
+	}
+	handler, err := newPhaseHandler(&handlers.EchoHandler{}, conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := &types.Event{
+		Type: types.EventTypeProgress,
+		Meta: map[string]interface{}{"refname": "ref1", "correlation": "abc", "host": "nats1"},
+	}
+	out, err := handler.buildConfig(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if topic, _ := out.Options.GetString("topic"); topic != "jobs.ref1.progress" {
+		t.Fatalf("topic: %s", topic)
+	}
+	if out.Options["retries"] != 3 {
+		t.Fatalf("retries: %v", out.Options["retries"])
+	}
+	if hdr := out.Options["headers"].(map[interface{}]interface{})["X-Correlation-Id"]; hdr != "abc" {
+		t.Fatalf("header: %v", hdr)
+	}
+	if server := out.Options["servers"].([]interface{})[0]; server != "nats://nats1:4222" {
+		t.Fatalf("server: %v", server)
+	}
+
+	// The original config must not be modified
+	if topic, _ := conf.Options.GetString("topic"); topic != "jobs.${Meta.refname}.progress" {
+		t.Fatalf("original topic modified: %s", topic)
+	}
+}
+
+func Test_phaseHandler_buildConfig_EnvSecret(t *testing.T) {
+	os.Setenv("FLOOP_TEST_ENV", "env-value")
+	defer os.Unsetenv("FLOOP_TEST_ENV")
+
+	conf := &types.HandlerConfig{
+		URI:     "http://localhost/${Env.FLOOP_TEST_ENV}",
+		Body:    "${Secret.api_token}",
+		Options: types.Options{"headers": map[interface{}]interface{}{"Authorization": "Bearer ${Secret.api_token}"}},
+	}
+	handler, err := newPhaseHandler(&handlers.EchoHandler{}, conf, newTemplateVars(map[string]string{"api_token": "s3cr3t"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := handler.buildConfig(&types.Event{Type: types.EventTypeBegin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out.URI != "http://localhost/env-value" {
+		t.Fatalf("uri: %s", out.URI)
+	}
+	if out.Body != "s3cr3t" {
+		t.Fatalf("body: %s", out.Body)
+	}
+	if hdr := out.Options["headers"].(map[interface{}]interface{})["Authorization"]; hdr != "Bearer s3cr3t" {
+		t.Fatalf("header: %v", hdr)
+	}
+}
+
+func Test_NewLifecycle_TemplateError(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handlers[types.EventTypeBegin] = []*types.HandlerConfig{
+		{Type: "echo", Engine: engineGoTemplate, Body: "{{ .Meta.refname "},
+	}
+
+	if _, err := NewLifecycle(conf); err == nil {
+		t.Fatal("should fail on template syntax error")
+	}
+}
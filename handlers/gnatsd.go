@@ -2,18 +2,36 @@ package handlers
 
 import (
 	"fmt"
-	"log"
 	"time"
 
 	"github.com/d3sw/floop/types"
-	"github.com/nats-io/go-nats"
+	"github.com/nats-io/nats.go"
 )
 
+const (
+	gnatsdModePublish = "publish"
+	gnatsdModeRequest = "request"
+)
+
+// Default time to wait for a reply in request mode
+var dGnatsdRequestTimeout = 5 * time.Second
+
 // GnatsdHandler is handler to publish lifecycle events to gnatsd
 type GnatsdHandler struct {
 	conf *types.HandlerConfig
 	// Nats connection
 	conn *nats.Conn
+
+	// publish (default) or request.  Request waits for a JSON reply which is returned as the
+	// context
+	mode    string
+	timeout time.Duration
+	// Flush after each publish returning any error
+	flush bool
+	// Max time to wait for pending messages to be sent on flush and close
+	flushTimeout time.Duration
+	// Closed once the connection is closed
+	closed chan struct{}
 }
 
 // Init initializes the connection to the gnatsd cluster
@@ -24,18 +42,39 @@ func (lc *GnatsdHandler) Init(conf *types.HandlerConfig) error {
 		return fmt.Errorf("topic required or invalid topic: %v", topic)
 	}
 
-	opts := nats.Options{
-		AllowReconnect: true,
-		MaxReconnect:   10,
-		ReconnectWait:  5 * time.Second,
-		Timeout:        1 * time.Second,
-		Url:            conf.URI,
-		AsyncErrorCB: func(conn *nats.Conn, sub *nats.Subscription, err error) {
-			log.Println("[ERROR]", err)
-		},
+	lc.mode = gnatsdModePublish
+	if mode, ok := lc.conf.Options.GetString("mode"); ok && mode != "" {
+		if mode != gnatsdModePublish && mode != gnatsdModeRequest {
+			return fmt.Errorf("invalid mode: %s", mode)
+		}
+		lc.mode = mode
+	}
+
+	lc.timeout = dGnatsdRequestTimeout
+	if _, ok := lc.conf.Options["timeout"]; ok {
+		if lc.timeout, ok = lc.conf.Options.GetDuration("timeout"); !ok || lc.timeout <= 0 {
+			return fmt.Errorf("invalid timeout: %v", lc.conf.Options["timeout"])
+		}
+	}
+
+	opts, err := newNatsOptions(conf.URI, conf.Options)
+	if err != nil {
+		return err
+	}
+	if lc.flushTimeout, err = natsFlushTimeout(conf.Options); err != nil {
+		return err
+	}
+
+	if err = validateHeaders(conf.Options); err != nil {
+		return err
 	}
 
-	var err error
+	lc.flush, _ = conf.Options.GetBool("flush")
+
+	lc.closed = make(chan struct{})
+	opts.DrainTimeout = lc.flushTimeout
+	opts.ClosedCB = func(*nats.Conn) { close(lc.closed) }
+
 	lc.conn, err = opts.Connect()
 	return err
 }
@@ -52,20 +91,64 @@ func (lc *GnatsdHandler) Handle(event *types.Event, conf *types.HandlerConfig) (
 
 	fmt.Printf("[gnatsd] phase=%s topic=%s %+v\n", event.Type, topic, event.Data)
 
+	headers, err := parseHeaders(conf.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &nats.Msg{Subject: topic, Data: []byte(conf.Body)}
+	if len(headers) > 0 {
+		msg.Header = make(nats.Header, len(headers))
+		for k, v := range headers {
+			msg.Header.Set(k, v)
+		}
+	}
+
+	if lc.mode == gnatsdModeRequest {
+		reply, err := lc.conn.RequestMsg(msg, lc.timeout)
+		if err != nil {
+			return nil, err
+		}
+		return decodeJSON(reply.Data)
+	}
+
 	// Publish the body as bytes
-	err := lc.conn.Publish(topic, []byte(conf.Body))
+	if err = lc.conn.PublishMsg(msg); err != nil {
+		return nil, err
+	}
 
-	// if err == nil {
-	// 	if err = lc.econn.Flush(); err != nil {
-	// 		err = lc.econn.LastError()
-	// 	}
-	// }
+	// Confirm the server received the message
+	if lc.flush {
+		if err := lc.conn.FlushTimeout(lc.flushTimeout); err != nil {
+			return nil, err
+		}
+		if err := lc.conn.LastError(); err != nil {
+			return nil, err
+		}
+	}
 
-	return nil, err
+	return nil, nil
 }
 
-// CloseConnection - closes the nats connection ensuring the last event gets published before the app terminates
+// CloseConnection - drains the nats connection ensuring the last event gets published before the
+// app terminates
 func (lc *GnatsdHandler) CloseConnection() error {
-	lc.conn.Close()
-	return nil
+	if lc.conn == nil || lc.conn.IsClosed() {
+		return nil
+	}
+
+	if err := lc.conn.Drain(); err != nil {
+		lc.conn.Close()
+		return err
+	}
+
+	// Drain closes the connection once pending messages are sent or the drain timeout expires
+	select {
+	case <-lc.closed:
+	case <-time.After(lc.flushTimeout + time.Second):
+		lc.conn.Close()
+		return fmt.Errorf("timed out draining connection")
+	}
+
+	return lc.conn.LastError()
 }
@@ -5,7 +5,7 @@ import (
 	"time"
 
 	"github.com/d3sw/floop/types"
-	"github.com/nats-io/go-nats"
+	"github.com/nats-io/nats.go"
 )
 
 func TestGnatsdHandler(t *testing.T) {
@@ -34,3 +34,67 @@ func TestGnatsdHandler(t *testing.T) {
 	// t.Logf("%+v", msg)
 
 }
+
+func TestGnatsdHandler_Request(t *testing.T) {
+	conf := &types.HandlerConfig{
+		URI:     nats.DefaultURL,
+		Options: types.Options{"topic": "test.lease", "mode": "request", "timeout": "2s"},
+		Body:    "foobar",
+	}
+
+	h := &GnatsdHandler{}
+	if err := h.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer h.CloseConnection()
+
+	sub, err := h.conn.Subscribe("test.lease", func(msg *nats.Msg) {
+		h.conn.Publish(msg.Reply, []byte(`{"taskId": "task-1"}`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	r, err := h.Handle(&types.Event{Type: types.EventTypeBegin, Timestamp: time.Now().UnixNano()}, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r["taskId"] != "task-1" {
+		t.Fatalf("context: %v", r)
+	}
+}
+
+func TestGnatsdHandler_Headers(t *testing.T) {
+	conf := &types.HandlerConfig{
+		URI: nats.DefaultURL,
+		Options: types.Options{
+			"topic":   "test.headers",
+			"headers": map[interface{}]interface{}{"Floop-Event": "begin", "Content-Type": "application/octet-stream"},
+		},
+		Body: "\x00\x01",
+	}
+
+	h := &GnatsdHandler{}
+	if err := h.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer h.CloseConnection()
+
+	sub, err := h.conn.SubscribeSync("test.headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = h.Handle(&types.Event{Type: types.EventTypeBegin, Timestamp: time.Now().UnixNano()}, conf); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Floop-Event") != "begin" || string(msg.Data) != "\x00\x01" {
+		t.Fatalf("header=%v data=%q", msg.Header, msg.Data)
+	}
+}
@@ -2,12 +2,22 @@ package handlers
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/d3sw/floop/resolver"
@@ -19,11 +29,60 @@ var (
 	errInvalidMethod = "invalid method: %d"
 )
 
+// Network error classes that may be retried
+const (
+	errClassTimeout    = "timeout"
+	errClassConnection = "connection"
+	errClassDNS        = "dns"
+)
+
+// Default idempotency header
+const dIdempotencyKey = "Idempotency-Key"
+
+// Default request timeout
+var dHTTPTimeout = 3 * time.Second
+
+// Default upper bound of a server requested Retry-After delay
+var dMaxRetryAfter = 30 * time.Second
+
+var (
+	// Statuses retried by default
+	dRetryCodes = []statusRange{{408, 408}, {429, 429}, {500, 500}, {502, 504}}
+	// Network errors retried by default
+	dRetryErrors = map[string]bool{errClassTimeout: true, errClassConnection: true, errClassDNS: true}
+)
+
 type endpointConfig struct {
 	//URI     string
 	Method string
 	//Body    string
-	Headers map[string]string
+
+	// Status codes considered successful.  Defaults to 2xx
+	SuccessCodes []statusRange
+	// Response decoding: json (default), text or none
+	Response string
+	// Context key to set to the response status code
+	ResponseStatus string
+	// Response header to context key mapping
+	ResponseHeaders map[string]string
+
+	// Status codes that are retried.  Anything else that is not a success fails immediately
+	RetryCodes []statusRange
+	// Network error classes that are retried: timeout, connection and dns
+	RetryErrors map[string]bool
+	// Longest Retry-After delay honored.  Longer delays are clamped
+	MaxRetryAfter time.Duration
+	// Request body compression.  Only gzip is supported
+	Compress string
+
+	// Header set to a key derived from the event id and endpoint.  The value is the same for all
+	// attempts so servers can deduplicate retries
+	IdempotencyKey string
+}
+
+// statusRange is an inclusive range of http status codes
+type statusRange struct {
+	min, max int
 }
 
 // Backoff interface defines contract for backoff strategies
@@ -39,10 +98,10 @@ type LinearBackoff struct {
 // Next returns next time for retrying operation with linear strategy
 func (b LinearBackoff) Next(retry int) time.Duration {
 	if retry <= 0 {
-		return  time.Duration(0)
+		return time.Duration(0)
 	}
 
-	return  time.Duration(retry) * b.Interval
+	return time.Duration(retry) * b.Interval
 }
 
 // ConstantBackoff implements constant backoff
@@ -52,23 +111,56 @@ type ConstantBackoff struct {
 
 // Next returns next time for retrying operation with constant strategy
 func (b ConstantBackoff) Next(_ int) time.Duration {
-	return  b.Interval
+	return b.Interval
+}
+
+// ExponentialBackoff implements exponential backoff with full jitter.  The delay is a random
+// duration up to Interval*2^(retry-1), capped at Max if set.
+type ExponentialBackoff struct {
+	Interval time.Duration
+	Max      time.Duration
+}
+
+// Next returns next time for retrying operation with exponential strategy
+func (b ExponentialBackoff) Next(retry int) time.Duration {
+	if retry <= 0 || b.Interval <= 0 {
+		return time.Duration(0)
+	}
+
+	d := b.Interval
+	for i := 1; i < retry && d <= math.MaxInt64/2; i++ {
+		if b.Max > 0 && d >= b.Max {
+			break
+		}
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+
+	return time.Duration(rand.Int63n(int64(d) + 1))
 }
 
 // HTTPClientHandler implements a HTTP client handler for events
 type HTTPClientHandler struct {
-	conf   *endpointConfig
-	client *http.Client
-	resolv *resolver.Resolver
+	conf    *endpointConfig
+	client  *http.Client
+	resolv  *resolver.Resolver
 	backoff Backoff
 	retries int
+	auth    authProvider
+
+	// Progress event batching.  nil if not enabled
+	batch *httpBatch
+	// Multipart upload of the child output.  nil if not enabled
+	multipart *multipartConfig
 }
 
 // NewHTTPClientHandler instantiates a new HTTPClientHandler
 func NewHTTPClientHandler(resolver *resolver.Resolver, backoff Backoff, maxRetries int) *HTTPClientHandler {
 	return &HTTPClientHandler{
-		client: &http.Client{Timeout: 3 * time.Second},
-		resolv: resolver,
+		client:  &http.Client{Timeout: dHTTPTimeout},
+		resolv:  resolver,
 		backoff: backoff,
 		retries: maxRetries,
 	}
@@ -81,8 +173,113 @@ func (handler *HTTPClientHandler) Init(conf *types.HandlerConfig) error {
 	handler.conf = &endpointConfig{
 		//URI:     config["uri"].(string),
 		//URI:     conf.URI,
-		Method:  config["method"].(string),
-		Headers: make(map[string]string),
+		Method:        config["method"].(string),
+		SuccessCodes:  []statusRange{{200, 299}},
+		Response:      "json",
+		RetryCodes:    dRetryCodes,
+		RetryErrors:   dRetryErrors,
+		MaxRetryAfter: dMaxRetryAfter,
+	}
+
+	client, err := newHTTPClient(config)
+	if err != nil {
+		return err
+	}
+	handler.client = client
+
+	if handler.auth, err = newAuthProvider(config, client); err != nil {
+		return err
+	}
+
+	if codes, ok := config["success_codes"]; ok {
+		ranges, err := parseStatusRanges(codes)
+		if err != nil {
+			return err
+		}
+		handler.conf.SuccessCodes = ranges
+	}
+
+	if response, ok := config.GetString("response"); ok {
+		switch response {
+		case "json", "text", "none":
+			handler.conf.Response = response
+		default:
+			return fmt.Errorf("invalid response decoding: %s", response)
+		}
+	}
+
+	if codes, ok := config["retry_codes"]; ok {
+		ranges, err := parseStatusRanges(codes)
+		if err != nil {
+			return err
+		}
+		handler.conf.RetryCodes = ranges
+	}
+
+	if classes, ok := config["retry_errors"]; ok {
+		list, ok := classes.([]interface{})
+		if !ok {
+			return fmt.Errorf("invalid retry_errors data type %#v", classes)
+		}
+		handler.conf.RetryErrors = make(map[string]bool, len(list))
+		for _, c := range list {
+			switch c {
+			case errClassTimeout, errClassConnection, errClassDNS:
+				handler.conf.RetryErrors[c.(string)] = true
+			default:
+				return fmt.Errorf("invalid retry error class %#v", c)
+			}
+		}
+	}
+
+	if _, ok := config["max_retry_after"]; ok {
+		d, ok := config.GetDuration("max_retry_after")
+		if !ok || d <= 0 {
+			return fmt.Errorf("invalid max_retry_after %#v", config["max_retry_after"])
+		}
+		handler.conf.MaxRetryAfter = d
+	}
+
+	if compress, ok := config.GetString("compress"); ok && compress != "" {
+		if compress != "gzip" {
+			return fmt.Errorf("compression unsupported: %s", compress)
+		}
+		handler.conf.Compress = compress
+	}
+
+	if handler.batch, err = newHTTPBatch(config); err != nil {
+		return err
+	}
+
+	if handler.multipart, err = newMultipartConfig(config); err != nil {
+		return err
+	}
+
+	switch key := config["idempotency_key"].(type) {
+	case nil:
+	case bool:
+		if key {
+			handler.conf.IdempotencyKey = dIdempotencyKey
+		}
+	case string:
+		handler.conf.IdempotencyKey = key
+	default:
+		return fmt.Errorf("invalid idempotency_key data type %#v", key)
+	}
+
+	handler.conf.ResponseStatus, _ = config.GetString("response_status")
+
+	if rh, ok := config.GetOptions("response_headers"); ok {
+		handler.conf.ResponseHeaders = make(map[string]string, len(rh))
+		for k := range rh {
+			v, ok := rh.GetString(k)
+			if !ok {
+				return fmt.Errorf("invalid response header context key %#v", rh[k])
+			}
+			handler.conf.ResponseHeaders[k] = v
+		}
+	} else if _, ok := config["response_headers"]; ok {
+		return fmt.Errorf("invalid response_headers data type %#v", config["response_headers"])
 	}
 
 	//if _, ok := config["body"]; ok {
@@ -90,97 +287,446 @@ func (handler *HTTPClientHandler) Init(conf *types.HandlerConfig) error {
 	//handler.conf.Body = string(conf.Body)
 	//}
 
-	if hdrs, ok := config["headers"]; ok {
-		hm, ok := hdrs.(map[interface{}]interface{})
+	if ce, ok := config.GetOptions("cloudevents"); ok {
+		if mode, _ := ce.GetString("mode"); mode != "" && mode != "structured" && mode != "binary" {
+			return fmt.Errorf("invalid cloudevents mode: %s", mode)
+		}
+	}
+
+	return validateHeaders(config)
+}
+
+// newHTTPClient builds the client from the timeout, tls, proxy and keep-alive options
+func newHTTPClient(config types.Options) (*http.Client, error) {
+	client := &http.Client{Timeout: dHTTPTimeout}
+	if _, ok := config["timeout"]; ok {
+		if client.Timeout, ok = config.GetDuration("timeout"); !ok {
+			return nil, fmt.Errorf("invalid timeout %#v", config["timeout"])
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	tlsConf, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConf != nil {
+		transport.TLSClientConfig = tlsConf
+	}
+
+	if proxy, ok := config.GetString("proxy"); ok && proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if keepalive, ok := config.GetBool("keepalive"); ok && !keepalive {
+		transport.DisableKeepAlives = true
+	}
+	if interval, ok := config.GetDuration("keepalive_interval"); ok {
+		transport.DialContext = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: interval}).DialContext
+	}
+	if idle, ok := config.GetDuration("idle_timeout"); ok {
+		transport.IdleConnTimeout = idle
+	}
+	if maxIdle, ok := config.GetInt("max_idle_conns"); ok {
+		transport.MaxIdleConnsPerHost = maxIdle
+	}
+
+	client.Transport = transport
+	return client, nil
+}
+
+// parseHeaders returns the headers from the options.  Headers are re-parsed from the normalized
+// config for each event as values may be interpolated.
+func parseHeaders(config types.Options) (map[string]string, error) {
+	headers := make(map[string]string)
+
+	hdrs, ok := config["headers"]
+	if !ok {
+		return headers, nil
+	}
+
+	hm, ok := hdrs.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid header data type %#v", hdrs)
+	}
+	for k, v := range hm {
+		key, ok := k.(string)
 		if !ok {
-			return fmt.Errorf("invalid header data type %#v", config["headers"])
+			return nil, fmt.Errorf("invalid header name %#v", k)
 		}
-		for k, v := range hm {
-			key := k.(string)
-			value := v.(string)
-			handler.conf.Headers[key] = value
+		value, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid header value %#v", v)
 		}
+		headers[key] = value
 	}
 
-	return nil
+	return headers, nil
+}
+
+// validateHeaders checks the headers option on Init.  They are applied per event from the
+// normalized config.
+func validateHeaders(config types.Options) error {
+	_, err := parseHeaders(config)
+	return err
 }
 
 // Handle handles an event by making an http call per the config.  Event is the raw event and
 // HandlerConfig is the normalized config after interpolations have been applied.
 func (handler *HTTPClientHandler) Handle(event *types.Event, conf *types.HandlerConfig) (map[string]interface{}, error) {
-	resp, err := handler.httpDo(conf)
+	// Progress events are delivered in batches
+	if handler.batch != nil && event.Type == types.EventTypeProgress {
+		return nil, handler.addToBatch(conf)
+	}
+
+	headers, err := parseHeaders(conf.Options)
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf(resp.Status)
+	if conf.CloudEvent != nil {
+		applyCloudEvent(conf, headers)
 	}
 
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		if err == io.EOF {
-			return nil, nil
+	if handler.conf.IdempotencyKey != "" {
+		headers[handler.conf.IdempotencyKey] = idempotencyKey(event.ID, handler.conf.Method, conf.URI)
+	}
+
+	body := []byte(conf.Body)
+	// Output is only available to the terminal phases
+	if handler.multipart != nil && event.Result != nil {
+		var contentType string
+		if body, contentType, err = handler.multipart.encode(conf.Body, event.Result); err != nil {
+			return nil, err
 		}
+		headers["Content-Type"] = contentType
+	}
+
+	payload, err := handler.encodeBody(body, headers)
+	if err != nil {
 		return nil, err
 	}
 
+	resp, err := handler.httpDo(handler.conf.Method, conf, headers, payload)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 
-	var r map[string]interface{}
-	if err = json.Unmarshal(b, &r); err != nil {
+	if !handler.isSuccess(resp.StatusCode) {
+		return nil, errors.New(resp.Status)
+	}
+
+	r, err := handler.decodeResponse(resp)
+	if err != nil {
 		return nil, err
 	}
 
+	// Map the status and headers into the context
+	if handler.conf.ResponseStatus != "" || len(handler.conf.ResponseHeaders) > 0 {
+		if r == nil {
+			r = make(map[string]interface{})
+		}
+		if handler.conf.ResponseStatus != "" {
+			r[handler.conf.ResponseStatus] = resp.StatusCode
+		}
+		for hdr, key := range handler.conf.ResponseHeaders {
+			if v := resp.Header.Get(hdr); v != "" {
+				r[key] = v
+			}
+		}
+	}
+
 	return r, nil
 }
 
-func (handler *HTTPClientHandler) httpDo(conf *types.HandlerConfig) (*http.Response, error) {
-	buff := bytes.NewBuffer([]byte(conf.Body))
+// decodeResponse decodes the response body per the configured decoding.  Text and non-object
+// JSON responses are returned under the body key.
+func (handler *HTTPClientHandler) decodeResponse(resp *http.Response) (map[string]interface{}, error) {
+	if handler.conf.Response == "none" {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if handler.conf.Response == "text" {
+		return map[string]interface{}{"body": string(b)}, nil
+	}
+
+	return decodeJSON(b)
+}
+
+// idempotencyKey returns the key for an event sent to an endpoint.  All handlers of a phase share
+// the event id so the method and uri are hashed in to keep handlers sending to the same api from
+// colliding.
+func idempotencyKey(eventID, method, uri string) string {
+	if eventID == "" {
+		eventID = types.NewID()
+	}
+	sum := sha256.Sum256([]byte(method + " " + uri))
+	return fmt.Sprintf("%s-%x", eventID, sum[:8])
+}
+
+// decodeJSON decodes a response into a context map.  Non-object values are returned under the
+// body key and an empty response returns nil.
+func decodeJSON(b []byte) (map[string]interface{}, error) {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	if r, ok := v.(map[string]interface{}); ok {
+		return r, nil
+	}
+	return map[string]interface{}{"body": v}, nil
+}
+
+func (handler *HTTPClientHandler) isSuccess(code int) bool {
+	return inRanges(handler.conf.SuccessCodes, code)
+}
+
+// shouldRetry returns whether the failed request should be retried along with the minimum
+// delay requested by the server via Retry-After
+func (handler *HTTPClientHandler) shouldRetry(resp *http.Response, err error) (bool, time.Duration) {
+	if err != nil {
+		return handler.conf.RetryErrors[errorClass(err)], 0
+	}
+	if !inRanges(handler.conf.RetryCodes, resp.StatusCode) {
+		return false, 0
+	}
+	return true, retryAfter(resp)
+}
 
+func inRanges(ranges []statusRange, code int) bool {
+	for _, r := range ranges {
+		if code >= r.min && code <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// errorClass returns the class of a network error or an empty string if it is not one we know
+// how to classify e.g. tls or malformed request errors.
+func errorClass(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return errClassDNS
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errClassTimeout
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return errClassConnection
+	}
+
+	return ""
+}
+
+// retryAfter returns the delay from the Retry-After header.  It may be in seconds or an http date.
+func retryAfter(resp *http.Response) time.Duration {
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if v == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+		return 0
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// parseStatusRanges parses a list of status codes.  Each may be a code, a range i.e. 200-204 or
+// a class i.e. 2xx
+func parseStatusRanges(v interface{}) ([]statusRange, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+
+	ranges := make([]statusRange, 0, len(list))
+	for _, item := range list {
+		var r statusRange
+		var err error
+
+		switch val := item.(type) {
+		case int:
+			r = statusRange{val, val}
+		case string:
+			r, err = parseStatusRange(val)
+		default:
+			err = fmt.Errorf("invalid status code %#v", item)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+
+	return ranges, nil
+}
+
+func parseStatusRange(s string) (statusRange, error) {
+	s = strings.TrimSpace(s)
+
+	if len(s) == 3 && strings.HasSuffix(strings.ToLower(s), "xx") {
+		class, err := strconv.Atoi(s[:1])
+		if err != nil {
+			return statusRange{}, fmt.Errorf("invalid status code class %s", s)
+		}
+		return statusRange{class * 100, class*100 + 99}, nil
+	}
+
+	arr := strings.SplitN(s, "-", 2)
+	min, err := strconv.Atoi(strings.TrimSpace(arr[0]))
+	if err != nil {
+		return statusRange{}, fmt.Errorf("invalid status code %s", s)
+	}
+	max := min
+	if len(arr) == 2 {
+		if max, err = strconv.Atoi(strings.TrimSpace(arr[1])); err != nil || max < min {
+			return statusRange{}, fmt.Errorf("invalid status code range %s", s)
+		}
+	}
+
+	return statusRange{min, max}, nil
+}
+
+// applyCloudEvent sets the body and headers for the configured CloudEvents content mode.  The
+// body already holds the structured envelope.  In binary mode the attributes are sent as headers
+// and the body is the event data.
+func applyCloudEvent(conf *types.HandlerConfig, headers map[string]string) {
+	mode := "structured"
+	if opts, ok := conf.Options.GetOptions("cloudevents"); ok {
+		if m, ok := opts.GetString("mode"); ok && m != "" {
+			mode = m
+		}
+	}
+
+	if mode == "binary" {
+		for k, v := range conf.CloudEvent.Headers() {
+			headers[k] = v
+		}
+		conf.Body = string(conf.CloudEvent.Data)
+		return
+	}
+
+	headers["Content-Type"] = "application/cloudevents+json"
+}
+
+// encodeBody compresses the body if configured setting the Content-Encoding header
+func (handler *HTTPClientHandler) encodeBody(body []byte, headers map[string]string) ([]byte, error) {
+	if handler.conf.Compress == "" || len(body) == 0 {
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	headers["Content-Encoding"] = handler.conf.Compress
+	return buf.Bytes(), nil
+}
+
+// httpDo makes the request retrying retryable failures up to the configured number of retries.
+// The delay is the larger of the backoff and the Retry-After header.  The payload is the encoded
+// body to send.
+func (handler *HTTPClientHandler) httpDo(method string, conf *types.HandlerConfig, headers map[string]string, payload []byte) (*http.Response, error) {
 	var response *http.Response
 	var err error
 
-	attempt := 1
-	for {
-		discoveredURI, err := handler.resolv.Discover(conf.URI)
-		if err != nil {
-			log.Printf("[ERROR] Discovering URI [%s]: %s\n", conf.URI, err.Error())
+	for retry := 0; ; retry++ {
+		discoveredURI, dErr := handler.resolv.Discover(conf.URI)
+		if dErr != nil {
+			log.Printf("[ERROR] Discovering URI [%s]: %s\n", conf.URI, dErr.Error())
 			log.Println("[DEBUG] Will be used system DNS server")
 		} else {
 			conf.URI = discoveredURI
 		}
 
-		req, err := http.NewRequest(handler.conf.Method, conf.URI, buff)
-		if err != nil {
+		// The body is rebuilt for each attempt as the previous one has been consumed
+		var req *http.Request
+		if req, err = http.NewRequest(method, conf.URI, bytes.NewReader(payload)); err != nil {
 			return nil, err
 		}
 
-		if handler.conf.Headers != nil {
-			for k, v := range handler.conf.Headers {
-				req.Header.Set(k, v)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		// Applied per attempt so signatures and tokens are fresh
+		if handler.auth != nil {
+			authOpts, _ := conf.Options.GetOptions("auth")
+			if err = handler.auth.Apply(req, string(payload), authOpts); err != nil {
+				return nil, err
 			}
 		}
 
 		log.Printf("[DEBUG] handler=http uri='%s' body='%s'", conf.URI, conf.Body)
 		response, err = handler.client.Do(req)
-		if err == nil && response.StatusCode == 200{
+		if err == nil && handler.isSuccess(response.StatusCode) {
 			break
 		}
 
-		if attempt >= handler.retries {
+		ok, wait := handler.shouldRetry(response, err)
+		if !ok || retry >= handler.retries {
 			break
 		}
 
-		time.Sleep(handler.backoff.Next(attempt))
-		attempt ++
+		if response != nil {
+			log.Printf("[DEBUG] handler=http uri='%s' retry=%d status=%d", conf.URI, retry+1, response.StatusCode)
+			// Drain so the connection can be reused
+			io.Copy(ioutil.Discard, response.Body)
+			response.Body.Close()
+		} else {
+			log.Printf("[DEBUG] handler=http uri='%s' retry=%d %v", conf.URI, retry+1, err)
+		}
+
+		if wait > handler.conf.MaxRetryAfter {
+			log.Printf("[DEBUG] handler=http uri='%s' retry-after=%v clamped to %v", conf.URI, wait, handler.conf.MaxRetryAfter)
+			wait = handler.conf.MaxRetryAfter
+		}
+		if d := handler.backoff.Next(retry + 1); d > wait {
+			wait = d
+		}
+		time.Sleep(wait)
 	}
 
 	return response, err
 }
 
-// CloseConnection - not implemented
+// CloseConnection flushes any batched events
 func (handler *HTTPClientHandler) CloseConnection() error {
-	//not implemented
-	return nil
+	return handler.Flush()
 }
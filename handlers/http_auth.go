@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/d3sw/floop/types"
+)
+
+const (
+	authBasic  = "basic"
+	authBearer = "bearer"
+	authOAuth2 = "oauth2"
+	authHMAC   = "hmac"
+)
+
+var (
+	dSignatureHeader = "X-Signature"
+	dTimestampHeader = "X-Timestamp"
+
+	// Tokens are refreshed this long before they expire
+	dTokenRefreshWindow = 30 * time.Second
+)
+
+// authProvider authenticates a request.  Options are the normalized auth block for the event so
+// credentials may be interpolated e.g. from secrets.
+type authProvider interface {
+	Apply(req *http.Request, body string, opts types.Options) error
+}
+
+// newAuthProvider returns the provider for the auth block of the handler options or nil if the
+// block is not specified.  The client is used to request oauth2 tokens.
+func newAuthProvider(config types.Options, client *http.Client) (authProvider, error) {
+	if _, ok := config["auth"]; !ok {
+		return nil, nil
+	}
+	opts, ok := config.GetOptions("auth")
+	if !ok {
+		return nil, fmt.Errorf("invalid auth data type %#v", config["auth"])
+	}
+
+	typ, _ := opts.GetString("type")
+	switch typ {
+	case authBasic:
+		return &basicAuth{}, nil
+	case authBearer:
+		if v, _ := opts.GetString("token_file"); v == "" {
+			return nil, errors.New("auth token_file required")
+		}
+		return &bearerFileAuth{}, nil
+	case authOAuth2:
+		if v, _ := opts.GetString("token_url"); v == "" {
+			return nil, errors.New("auth token_url required")
+		}
+		return &oauth2Auth{client: client}, nil
+	case authHMAC:
+		if v, _ := opts.GetString("secret"); v == "" {
+			return nil, errors.New("auth secret required")
+		}
+		return &hmacAuth{}, nil
+	}
+
+	return nil, fmt.Errorf("auth type unsupported: %s", typ)
+}
+
+// basicAuth sets the username and password
+type basicAuth struct{}
+
+func (a *basicAuth) Apply(req *http.Request, _ string, opts types.Options) error {
+	username, _ := opts.GetString("username")
+	password, _ := opts.GetString("password")
+	req.SetBasicAuth(username, password)
+	return nil
+}
+
+// bearerFileAuth sets a bearer token read from a file.  The file is re-read when it changes so
+// tokens rotated on disk are picked up.
+type bearerFileAuth struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	token   string
+}
+
+func (a *bearerFileAuth) Apply(req *http.Request, _ string, opts types.Options) error {
+	path, _ := opts.GetString("token_file")
+	token, err := a.load(path)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (a *bearerFileAuth) load(path string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if path == a.path && fi.ModTime().Equal(a.modTime) && fi.Size() == a.size {
+		return a.token, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	a.path, a.modTime, a.size = path, fi.ModTime(), fi.Size()
+	a.token = strings.TrimSpace(string(b))
+
+	return a.token, nil
+}
+
+// oauth2Auth requests tokens with the client credentials grant.  Tokens are cached until shortly
+// before they expire or the credentials change.
+type oauth2Auth struct {
+	client *http.Client
+
+	mu     sync.Mutex
+	key    string // token url and credentials the token was issued for
+	token  string
+	expiry time.Time // zero if the token does not expire
+}
+
+type oauth2Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func (a *oauth2Auth) Apply(req *http.Request, _ string, opts types.Options) error {
+	token, err := a.getToken(opts)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (a *oauth2Auth) getToken(opts types.Options) (string, error) {
+	tokenURL, _ := opts.GetString("token_url")
+	clientID, _ := opts.GetString("client_id")
+	clientSecret, _ := opts.GetString("client_secret")
+	key := tokenURL + "\n" + clientID + "\n" + clientSecret
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && a.key == key && (a.expiry.IsZero() || time.Now().Before(a.expiry)) {
+		return a.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if scopes := optionStrings(opts["scopes"]); len(scopes) > 0 {
+		form.Set("scope", strings.Join(scopes, " "))
+	}
+	if audience, ok := opts.GetString("audience"); ok && audience != "" {
+		form.Set("audience", audience)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("oauth2 token request failed: %s", resp.Status)
+	}
+
+	var tok oauth2Token
+	if err = json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	if tok.AccessToken == "" {
+		return "", errors.New("oauth2 token response missing access_token")
+	}
+
+	a.key, a.token, a.expiry = key, tok.AccessToken, time.Time{}
+	if tok.ExpiresIn > 0 {
+		lifetime := time.Duration(tok.ExpiresIn) * time.Second
+		// Refresh early but never use less than half of the lifetime
+		window := dTokenRefreshWindow
+		if window > lifetime/2 {
+			window = lifetime / 2
+		}
+		a.expiry = time.Now().Add(lifetime - window)
+	}
+
+	return a.token, nil
+}
+
+// hmacAuth signs the request with HMAC-SHA256 over "<timestamp>.<body>".  The unix timestamp is
+// sent in the timestamp header so receivers can reject stale requests, and the signature is sent
+// as sha256=<hex> in the signature header.
+type hmacAuth struct{}
+
+func (a *hmacAuth) Apply(req *http.Request, body string, opts types.Options) error {
+	secret, _ := opts.GetString("secret")
+
+	sigHeader, _ := opts.GetString("signature_header")
+	if sigHeader == "" {
+		sigHeader = dSignatureHeader
+	}
+	tsHeader, _ := opts.GetString("timestamp_header")
+	if tsHeader == "" {
+		tsHeader = dTimestampHeader
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(tsHeader, ts)
+	req.Header.Set(sigHeader, "sha256="+signHMAC(secret, ts, body))
+	return nil
+}
+
+func signHMAC(secret, ts, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "." + body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// optionStrings returns a string or list of strings option as a slice
+func optionStrings(v interface{}) []string {
+	switch val := v.(type) {
+	case string:
+		return strings.Fields(val)
+	case []interface{}:
+		out := make([]string, 0, len(val))
+		for _, item := range val {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/d3sw/floop/types"
+)
+
+func testAuthRequest(t *testing.T, auth map[interface{}]interface{}, ts *httptest.Server, body string) {
+	opts := types.Options{"method": "POST", "response": "none", "auth": auth}
+	h := testHTTPHandler(t, opts)
+	if _, err := h.Handle(&types.Event{}, &types.HandlerConfig{URI: ts.URL, Body: body, Options: opts}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_HTTPAuth_Basic(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	testAuthRequest(t, map[interface{}]interface{}{"type": "basic", "username": "user", "password": "pass"}, ts, "")
+}
+
+func Test_HTTPAuth_BearerFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "floop-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("token1\n")
+	f.Close()
+
+	a := &bearerFileAuth{}
+	opts := types.Options{"token_file": f.Name()}
+	req, _ := http.NewRequest("GET", "http://localhost", nil)
+
+	if err = a.Apply(req, "", opts); err != nil {
+		t.Fatal(err)
+	}
+	if v := req.Header.Get("Authorization"); v != "Bearer token1" {
+		t.Fatalf("got %q", v)
+	}
+
+	// Rotate the token
+	if err = ioutil.WriteFile(f.Name(), []byte("token-2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(f.Name(), time.Now(), time.Now().Add(time.Second))
+
+	if err = a.Apply(req, "", opts); err != nil {
+		t.Fatal(err)
+	}
+	if v := req.Header.Get("Authorization"); v != "Bearer token-2" {
+		t.Fatalf("got %q", v)
+	}
+}
+
+func Test_HTTPAuth_OAuth2(t *testing.T) {
+	var tokenCalls int
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenCalls++
+		r.ParseForm()
+		id, secret, _ := r.BasicAuth()
+		if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("scope") != "a b" ||
+			id != "client" || secret != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"access_token":"abc","token_type":"bearer","expires_in":3600}`))
+	}))
+	defer tokenServer.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer abc" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	auth := map[interface{}]interface{}{
+		"type":          "oauth2",
+		"token_url":     tokenServer.URL,
+		"client_id":     "client",
+		"client_secret": "secret",
+		"scopes":        []interface{}{"a", "b"},
+	}
+	opts := types.Options{"method": "POST", "response": "none", "auth": auth}
+	h := testHTTPHandler(t, opts)
+	for i := 0; i < 3; i++ {
+		if _, err := h.Handle(&types.Event{}, &types.HandlerConfig{URI: ts.URL, Options: opts}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tokenCalls != 1 {
+		t.Fatalf("token should be cached: calls=%d", tokenCalls)
+	}
+
+	// Expired tokens are refreshed
+	h.auth.(*oauth2Auth).expiry = time.Now().Add(-time.Second)
+	if _, err := h.Handle(&types.Event{}, &types.HandlerConfig{URI: ts.URL, Options: opts}); err != nil {
+		t.Fatal(err)
+	}
+	if tokenCalls != 2 {
+		t.Fatalf("token should be refreshed: calls=%d", tokenCalls)
+	}
+}
+
+func Test_HTTPAuth_HMAC(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		expected := "sha256=" + signHMAC("key", r.Header.Get("X-Ts"), string(b))
+		if r.Header.Get("X-Ts") == "" || r.Header.Get("X-Signature") != expected {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	testAuthRequest(t, map[interface{}]interface{}{"type": "hmac", "secret": "key", "timestamp_header": "X-Ts"},
+		ts, `{"status":"COMPLETED"}`)
+}
+
+func Test_newAuthProvider_Invalid(t *testing.T) {
+	for _, auth := range []interface{}{
+		"basic",
+		map[interface{}]interface{}{"type": "digest"},
+		map[interface{}]interface{}{"type": "bearer"},
+		map[interface{}]interface{}{"type": "oauth2"},
+		map[interface{}]interface{}{"type": "hmac"},
+	} {
+		if _, err := newAuthProvider(types.Options{"auth": auth}, nil); err == nil {
+			t.Fatalf("should fail: %v", auth)
+		}
+	}
+}
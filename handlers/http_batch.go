@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/d3sw/floop/types"
+)
+
+const (
+	contentTypeJSON            = "application/json"
+	contentTypeCloudEventBatch = "application/cloudevents-batch+json"
+)
+
+// httpBatch collects rendered progress bodies to be POSTed as a JSON array once the size or
+// interval threshold is reached.
+type httpBatch struct {
+	size     int           // send once this many events are pending.  0 for no limit
+	interval time.Duration // send this long after the first pending event.  0 for no limit
+
+	sendMu sync.Mutex // serializes sends so batches are delivered in order
+
+	mu      sync.Mutex
+	pending []json.RawMessage
+	conf    *types.HandlerConfig // normalized config of the last pending event
+	timer   *time.Timer
+}
+
+// newHTTPBatch returns the batch from the batch block of the handler options or nil if the block
+// is not specified.
+func newHTTPBatch(config types.Options) (*httpBatch, error) {
+	if _, ok := config["batch"]; !ok {
+		return nil, nil
+	}
+	opts, ok := config.GetOptions("batch")
+	if !ok {
+		return nil, fmt.Errorf("invalid batch data type %#v", config["batch"])
+	}
+
+	b := &httpBatch{}
+	b.size, _ = opts.GetInt("size")
+	b.interval, _ = opts.GetDuration("interval")
+	if b.size <= 0 && b.interval <= 0 {
+		return nil, errors.New("batch size or interval required")
+	}
+
+	return b, nil
+}
+
+// addToBatch adds the rendered body to the batch sending it if the size threshold is reached.
+// Bodies that are not valid JSON are added as strings.
+func (handler *HTTPClientHandler) addToBatch(conf *types.HandlerConfig) error {
+	item := json.RawMessage(conf.Body)
+	if !json.Valid(item) {
+		b, err := json.Marshal(conf.Body)
+		if err != nil {
+			return err
+		}
+		item = b
+	}
+
+	b := handler.batch
+	b.mu.Lock()
+	b.pending = append(b.pending, item)
+	b.conf = conf
+	full := b.size > 0 && len(b.pending) >= b.size
+	if !full && b.interval > 0 && b.timer == nil {
+		b.timer = time.AfterFunc(b.interval, func() {
+			if err := handler.Flush(); err != nil {
+				log.Printf("[ERROR] handler=http batch %v", err)
+			}
+		})
+	}
+	b.mu.Unlock()
+
+	if full {
+		return handler.Flush()
+	}
+	return nil
+}
+
+// Flush sends any pending batched events.  It is called before the terminal phases so progress
+// is delivered first.
+func (handler *HTTPClientHandler) Flush() error {
+	b := handler.batch
+	if b == nil {
+		return nil
+	}
+
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+
+	b.mu.Lock()
+	items, conf := b.pending, b.conf
+	b.pending, b.conf = nil, nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.mu.Unlock()
+
+	if len(items) == 0 {
+		return nil
+	}
+	return handler.sendBatch(items, conf)
+}
+
+// sendBatch POSTs the items as a JSON array to the batch uri, defaulting to the handler uri.
+// Headers and auth are taken from the config of the last event.
+func (handler *HTTPClientHandler) sendBatch(items []json.RawMessage, conf *types.HandlerConfig) error {
+	body, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+
+	headers, err := parseHeaders(conf.Options)
+	if err != nil {
+		return err
+	}
+	headers["Content-Type"] = contentTypeJSON
+	if conf.CloudEvent != nil {
+		headers["Content-Type"] = contentTypeCloudEventBatch
+	}
+	if handler.conf.IdempotencyKey != "" {
+		headers[handler.conf.IdempotencyKey] = types.NewID()
+	}
+
+	bconf := conf.Clone()
+	bconf.Body = string(body)
+	if opts, ok := conf.Options.GetOptions("batch"); ok {
+		if uri, ok := opts.GetString("uri"); ok && uri != "" {
+			bconf.URI = uri
+		}
+	}
+
+	payload, err := handler.encodeBody(body, headers)
+	if err != nil {
+		return err
+	}
+
+	resp, err := handler.httpDo(http.MethodPost, bconf, headers, payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if !handler.isSuccess(resp.StatusCode) {
+		return fmt.Errorf("batch of %d: %s", len(items), resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+
+	"github.com/d3sw/floop/types"
+)
+
+// multipartConfig sends the rendered body and the captured output of the child as a multipart
+// form.  This keeps large output out of the JSON body.
+type multipartConfig struct {
+	Field  string // field name of the rendered body part
+	Stdout string // field name of the stdout file part
+	Stderr string // field name of the stderr file part
+	// Gzip the stdout and stderr parts
+	Compress bool
+}
+
+// newMultipartConfig returns the config from the multipart option or nil if it is not set.  The
+// option may be true for the defaults or a block overriding them.
+func newMultipartConfig(config types.Options) (*multipartConfig, error) {
+	v, ok := config["multipart"]
+	if !ok {
+		return nil, nil
+	}
+
+	m := &multipartConfig{Field: "body", Stdout: "stdout", Stderr: "stderr"}
+	if enabled, ok := v.(bool); ok {
+		if !enabled {
+			return nil, nil
+		}
+		return m, nil
+	}
+
+	opts, ok := config.GetOptions("multipart")
+	if !ok {
+		return nil, fmt.Errorf("invalid multipart data type %#v", v)
+	}
+	if field, ok := opts.GetString("field"); ok && field != "" {
+		m.Field = field
+	}
+	if field, ok := opts.GetString("stdout"); ok && field != "" {
+		m.Stdout = field
+	}
+	if field, ok := opts.GetString("stderr"); ok && field != "" {
+		m.Stderr = field
+	}
+	if compress, ok := opts.GetString("compress"); ok && compress != "" {
+		if compress != "gzip" {
+			return nil, fmt.Errorf("multipart compression unsupported: %s", compress)
+		}
+		m.Compress = true
+	}
+
+	return m, nil
+}
+
+// encode returns the multipart body along with its content type
+func (m *multipartConfig) encode(body string, result *types.ChildResult) ([]byte, string, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	hdr := make(textproto.MIMEHeader)
+	hdr.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"`, m.Field))
+	hdr.Set("Content-Type", contentTypeJSON)
+	part, err := mw.CreatePart(hdr)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err = part.Write([]byte(body)); err != nil {
+		return nil, "", err
+	}
+
+	if err = m.writeOutput(mw, m.Stdout, result.Stdout); err != nil {
+		return nil, "", err
+	}
+	if err = m.writeOutput(mw, m.Stderr, result.Stderr); err != nil {
+		return nil, "", err
+	}
+
+	if err = mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), mw.FormDataContentType(), nil
+}
+
+func (m *multipartConfig) writeOutput(mw *multipart.Writer, field string, data []byte) error {
+	filename := field + ".log"
+	contentType := "text/plain"
+	if m.Compress {
+		filename += ".gz"
+		contentType = "application/gzip"
+	}
+
+	hdr := make(textproto.MIMEHeader)
+	hdr.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, field, filename))
+	hdr.Set("Content-Type", contentType)
+	part, err := mw.CreatePart(hdr)
+	if err != nil {
+		return err
+	}
+
+	if !m.Compress {
+		_, err = part.Write(data)
+		return err
+	}
+
+	zw := gzip.NewWriter(part)
+	if _, err = zw.Write(data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
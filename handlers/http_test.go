@@ -1,5 +1,22 @@
 package handlers
 
+import (
+	"compress/gzip"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/d3sw/floop/resolver"
+	"github.com/d3sw/floop/types"
+)
+
 // func Test_HTTPClientHandler(t *testing.T) {
 // 	conf := &HTTPConfig{
 // 		EndpointConfig: &EndpointConfig{
@@ -14,3 +31,389 @@ package handlers
 // 		t.Fatal("failed to set uri")
 // 	}
 // }
+
+func testHTTPHandler(t *testing.T, opts types.Options) *HTTPClientHandler {
+	h := NewHTTPClientHandler(resolver.NewResolver(8600, "127.0.0.1"), ConstantBackoff{}, 0)
+	if err := h.Init(&types.HandlerConfig{Options: opts}); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func Test_HTTPClientHandler_SuccessCodes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/tasks/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`"created"`))
+	}))
+	defer ts.Close()
+
+	opts := types.Options{
+		"method":           "POST",
+		"success_codes":    []interface{}{200, "201-204"},
+		"response_status":  "status",
+		"response_headers": map[interface{}]interface{}{"Location": "location"},
+	}
+	h := testHTTPHandler(t, opts)
+
+	r, err := h.Handle(&types.Event{}, &types.HandlerConfig{URI: ts.URL, Options: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r["body"] != "created" || r["status"] != 201 || r["location"] != "/tasks/1" {
+		t.Fatalf("context: %v", r)
+	}
+
+	opts["success_codes"] = []interface{}{"200"}
+	h = testHTTPHandler(t, opts)
+	if _, err = h.Handle(&types.Event{}, &types.HandlerConfig{URI: ts.URL, Options: opts}); err == nil {
+		t.Fatal("201 should fail")
+	}
+}
+
+func Test_HTTPClientHandler_Response(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	opts := types.Options{"method": "GET", "response": "text"}
+	r, err := testHTTPHandler(t, opts).Handle(&types.Event{}, &types.HandlerConfig{URI: ts.URL, Options: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r["body"] != "OK" {
+		t.Fatalf("context: %v", r)
+	}
+
+	opts["response"] = "none"
+	if r, err = testHTTPHandler(t, opts).Handle(&types.Event{}, &types.HandlerConfig{URI: ts.URL, Options: opts}); err != nil || r != nil {
+		t.Fatalf("context: %v %v", r, err)
+	}
+
+	opts["response"] = "xml"
+	if err = NewHTTPClientHandler(nil, ConstantBackoff{}, 0).Init(&types.HandlerConfig{Options: opts}); err == nil {
+		t.Fatal("should fail on invalid response decoding")
+	}
+}
+
+func Test_ExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff{Interval: 100 * time.Millisecond, Max: time.Second}
+	if b.Next(0) != 0 {
+		t.Fatal("retry 0 should not wait")
+	}
+	for i := 1; i <= 70; i++ {
+		d := b.Next(i)
+		if d < 0 || d > b.Max {
+			t.Fatalf("retry=%d delay=%v", i, d)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		if d := b.Next(1); d > b.Interval {
+			t.Fatalf("retry=1 delay=%v", d)
+		}
+	}
+}
+
+func Test_HTTPClientHandler_Retry(t *testing.T) {
+	var calls int
+	status := http.StatusBadRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(status)
+		}
+	}))
+	defer ts.Close()
+
+	opts := types.Options{"method": "GET", "response": "none"}
+	h := testHTTPHandler(t, opts)
+	h.retries = 2
+
+	// Not retryable
+	if _, err := h.Handle(&types.Event{}, &types.HandlerConfig{URI: ts.URL, Options: opts}); err == nil {
+		t.Fatal("400 should fail")
+	}
+	if calls != 1 {
+		t.Fatalf("calls=%d", calls)
+	}
+
+	calls = 0
+	status = http.StatusServiceUnavailable
+	if _, err := h.Handle(&types.Event{}, &types.HandlerConfig{URI: ts.URL, Options: opts}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("calls=%d", calls)
+	}
+
+	// No retries
+	calls = 0
+	h.retries = 0
+	if _, err := h.Handle(&types.Event{}, &types.HandlerConfig{URI: ts.URL, Options: opts}); err == nil {
+		t.Fatal("503 should fail")
+	}
+	if calls != 1 {
+		t.Fatalf("calls=%d", calls)
+	}
+}
+
+func Test_HTTPClientHandler_MaxRetryAfter(t *testing.T) {
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "86400")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	opts := types.Options{"method": "GET", "response": "none", "max_retry_after": "10ms"}
+	h := testHTTPHandler(t, opts)
+	h.retries = 1
+
+	start := time.Now()
+	if _, err := h.Handle(&types.Event{}, &types.HandlerConfig{URI: ts.URL, Options: opts}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || time.Since(start) > time.Second {
+		t.Fatalf("calls=%d took=%v", calls, time.Since(start))
+	}
+
+	opts["max_retry_after"] = -1
+	if err := (&HTTPClientHandler{}).Init(&types.HandlerConfig{Options: opts}); err == nil {
+		t.Fatal("negative max_retry_after should fail")
+	}
+}
+
+func Test_retryAfter(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	if retryAfter(resp) != 0 {
+		t.Fatal("should be 0 without header")
+	}
+
+	resp.Header.Set("Retry-After", "2")
+	if d := retryAfter(resp); d != 2*time.Second {
+		t.Fatalf("got %v", d)
+	}
+
+	resp.Header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if d := retryAfter(resp); d <= 50*time.Second || d > time.Minute {
+		t.Fatalf("got %v", d)
+	}
+
+	resp.Header.Set("Retry-After", "soon")
+	if retryAfter(resp) != 0 {
+		t.Fatal("should be 0 when invalid")
+	}
+}
+
+func Test_errorClass(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	uri := ts.URL
+	ts.Close()
+
+	_, err := http.Get(uri)
+	if c := errorClass(err); c != errClassConnection {
+		t.Fatalf("class=%q %v", c, err)
+	}
+
+	if c := errorClass(errors.New("x509: certificate signed by unknown authority")); c != "" {
+		t.Fatalf("class=%q", c)
+	}
+}
+
+func Test_HTTPClientHandler_RetryBody(t *testing.T) {
+	var (
+		bodies []string
+		keys   []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer ts.Close()
+
+	opts := types.Options{"method": "POST", "response": "none", "idempotency_key": true}
+	h := testHTTPHandler(t, opts)
+	h.retries = 1
+
+	event := &types.Event{ID: "event-1"}
+	if _, err := h.Handle(event, &types.HandlerConfig{URI: ts.URL, Body: `{"a":1}`, Options: opts}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bodies) != 2 || bodies[0] != `{"a":1}` || bodies[1] != bodies[0] {
+		t.Fatalf("bodies: %q", bodies)
+	}
+	if !strings.HasPrefix(keys[0], "event-1-") || keys[1] != keys[0] {
+		t.Fatalf("keys: %q", keys)
+	}
+
+	// Another handler of the phase sending the same event to a different endpoint
+	opts["method"] = "PUT"
+	h = testHTTPHandler(t, opts)
+	if _, err := h.Handle(event, &types.HandlerConfig{URI: ts.URL + "/audit", Body: `{"a":1}`, Options: opts}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || !strings.HasPrefix(keys[2], "event-1-") || keys[2] == keys[0] {
+		t.Fatalf("keys: %q", keys)
+	}
+}
+
+func Test_HTTPClientHandler_TLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	caFile, err := ioutil.TempFile("", "floop-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	caFile.Close()
+
+	opts := types.Options{"method": "GET", "response": "none"}
+	if _, err = testHTTPHandler(t, opts).Handle(&types.Event{}, &types.HandlerConfig{URI: ts.URL, Options: opts}); err == nil {
+		t.Fatal("should fail verification")
+	}
+
+	opts["tls"] = map[interface{}]interface{}{"ca_file": caFile.Name(), "server_name": "example.com"}
+	opts["timeout"] = "10s"
+	h := testHTTPHandler(t, opts)
+	if h.client.Timeout != 10*time.Second {
+		t.Fatalf("timeout=%v", h.client.Timeout)
+	}
+	if _, err = h.Handle(&types.Event{}, &types.HandlerConfig{URI: ts.URL, Options: opts}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts["tls"] = map[interface{}]interface{}{"cert_file": caFile.Name()}
+	if err = NewHTTPClientHandler(nil, ConstantBackoff{}, 0).Init(&types.HandlerConfig{Options: opts}); err == nil {
+		t.Fatal("should fail without key_file")
+	}
+}
+
+func Test_HTTPClientHandler_Batch(t *testing.T) {
+	var batches [][]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil || r.Method != "POST" || r.URL.Path != "/batch" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var batch []interface{}
+		if err = json.NewDecoder(zr).Decode(&batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		batches = append(batches, batch)
+	}))
+	defer ts.Close()
+
+	opts := types.Options{
+		"method":   "PUT",
+		"compress": "gzip",
+		"batch":    map[interface{}]interface{}{"size": 2, "uri": ts.URL + "/batch"},
+	}
+	h := testHTTPHandler(t, opts)
+
+	event := &types.Event{Type: types.EventTypeProgress}
+	for _, body := range []string{`{"line":1}`, `{"line":2}`, `not json`} {
+		if _, err := h.Handle(event, &types.HandlerConfig{URI: ts.URL, Body: body, Options: opts}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("batches: %v", batches)
+	}
+
+	if err := h.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 2 || batches[1][0] != "not json" {
+		t.Fatalf("batches: %v", batches)
+	}
+
+	// Nothing pending
+	if err := h.Flush(); err != nil || len(batches) != 2 {
+		t.Fatalf("batches: %v %v", batches, err)
+	}
+}
+
+func Test_HTTPClientHandler_BatchInterval(t *testing.T) {
+	done := make(chan int, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []interface{}
+		json.NewDecoder(r.Body).Decode(&batch)
+		done <- len(batch)
+	}))
+	defer ts.Close()
+
+	opts := types.Options{"method": "POST", "batch": map[interface{}]interface{}{"interval": "50ms"}}
+	h := testHTTPHandler(t, opts)
+	event := &types.Event{Type: types.EventTypeProgress}
+	for i := 0; i < 3; i++ {
+		if _, err := h.Handle(event, &types.HandlerConfig{URI: ts.URL, Body: "{}", Options: opts}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case n := <-done:
+		if n != 3 {
+			t.Fatalf("batch size %d", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("batch not sent")
+	}
+}
+
+func Test_HTTPClientHandler_Multipart(t *testing.T) {
+	parts := map[string]string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		parts["body"] = r.FormValue("payload")
+		for _, name := range []string{"stdout", "stderr"} {
+			f, fh, err := r.FormFile(name)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			b, _ := ioutil.ReadAll(zr)
+			parts[fh.Filename] = string(b)
+		}
+	}))
+	defer ts.Close()
+
+	opts := types.Options{
+		"method":    "POST",
+		"multipart": map[interface{}]interface{}{"field": "payload", "compress": "gzip"},
+	}
+	h := testHTTPHandler(t, opts)
+
+	event := &types.Event{
+		Type:   types.EventTypeFailed,
+		Result: &types.ChildResult{Code: 1, Stdout: []byte("out"), Stderr: []byte("err \"quoted\"")},
+	}
+	if _, err := h.Handle(event, &types.HandlerConfig{URI: ts.URL, Body: `{"code":1}`, Options: opts}); err != nil {
+		t.Fatal(err)
+	}
+
+	if parts["body"] != `{"code":1}` || parts["stdout.log.gz"] != "out" || parts["stderr.log.gz"] != `err "quoted"` {
+		t.Fatalf("parts: %v", parts)
+	}
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/d3sw/floop/types"
+	"github.com/nats-io/nats.go"
+)
+
+var (
+	dJetStreamAckTimeout = 5 * time.Second
+	dJetStreamRetries    = 2
+)
+
+// JetStreamHandler is handler to publish lifecycle events to NATS JetStream.  Each publish waits
+// for the stream to acknowledge it and the event id along with a hash of the topic and body is used
+// as the message id so retries are deduplicated by the server.
+type JetStreamHandler struct {
+	conf *types.HandlerConfig
+	// Nats connection
+	conn *nats.Conn
+	js   nats.JetStreamContext
+
+	// Stream the message is expected to be stored in.  Optional
+	stream     string
+	ackTimeout time.Duration
+	// Number of retries on ack timeout
+	retries int
+}
+
+// Init connects to the nats cluster and creates the stream if configured to
+func (lc *JetStreamHandler) Init(conf *types.HandlerConfig) error {
+	lc.conf = conf
+	topic, ok := conf.Options.GetString("topic")
+	if !ok || topic == "" {
+		return fmt.Errorf("topic required or invalid topic: %v", topic)
+	}
+
+	lc.stream, _ = conf.Options.GetString("stream")
+
+	lc.ackTimeout = dJetStreamAckTimeout
+	if _, ok := conf.Options["ack_timeout"]; ok {
+		if lc.ackTimeout, ok = conf.Options.GetDuration("ack_timeout"); !ok || lc.ackTimeout <= 0 {
+			return fmt.Errorf("invalid ack_timeout: %v", conf.Options["ack_timeout"])
+		}
+	}
+
+	lc.retries = dJetStreamRetries
+	if _, ok := conf.Options["retries"]; ok {
+		if lc.retries, ok = conf.Options.GetInt("retries"); !ok || lc.retries < 0 {
+			return fmt.Errorf("invalid retries: %v", conf.Options["retries"])
+		}
+	}
+
+	if err := validateHeaders(conf.Options); err != nil {
+		return err
+	}
+
+	create, _ := conf.Options.GetBool("create_stream")
+	if _, ok := conf.Options["subjects"]; create && !ok && IsTemplated(topic) {
+		// The stream would only capture the literal template
+		return errors.New("subjects required to create stream with a templated topic")
+	}
+
+	opts, err := newNatsOptions(conf.URI, conf.Options)
+	if err != nil {
+		return err
+	}
+	if lc.conn, err = opts.Connect(); err != nil {
+		return err
+	}
+	if lc.js, err = lc.conn.JetStream(); err != nil {
+		lc.conn.Close()
+		return err
+	}
+
+	if create {
+		if err = lc.createStream(topic); err != nil {
+			lc.conn.Close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createStream adds the stream if it does not exist.  Subjects default to the topic.
+func (lc *JetStreamHandler) createStream(topic string) error {
+	if lc.stream == "" {
+		return errors.New("stream required to create stream")
+	}
+	if _, err := lc.js.StreamInfo(lc.stream); err == nil {
+		return nil
+	}
+
+	cfg := &nats.StreamConfig{Name: lc.stream, Subjects: []string{topic}}
+	if subjects, ok := lc.conf.Options["subjects"]; ok {
+		if cfg.Subjects = optionStrings(subjects); len(cfg.Subjects) == 0 {
+			return fmt.Errorf("invalid subjects %#v", subjects)
+		}
+	}
+	if storage, ok := lc.conf.Options.GetString("storage"); ok && storage != "" {
+		switch storage {
+		case "file":
+			cfg.Storage = nats.FileStorage
+		case "memory":
+			cfg.Storage = nats.MemoryStorage
+		default:
+			return fmt.Errorf("invalid storage: %s", storage)
+		}
+	}
+
+	if _, err := lc.js.AddStream(cfg); err != nil {
+		return fmt.Errorf("creating stream %s: %v", lc.stream, err)
+	}
+	log.Printf("[INFO] handler=jetstream created stream=%s subjects=%v", lc.stream, cfg.Subjects)
+	return nil
+}
+
+// Handle publishes to JetStream waiting for the ack.  The config is the normalized
+// config built using data from the child process.  This may be different from the one
+// used in Init
+func (lc *JetStreamHandler) Handle(event *types.Event, conf *types.HandlerConfig) (map[string]interface{}, error) {
+	// Get topic from config
+	topic, ok := conf.Options.GetString("topic")
+	if !ok || topic == "" {
+		return nil, fmt.Errorf("topic not specified")
+	}
+
+	headers, err := parseHeaders(conf.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []nats.PubOpt{nats.AckWait(lc.ackTimeout)}
+	if msgID := jetStreamMsgID(event, topic, conf.Body, conf.Options); msgID != "" {
+		opts = append(opts, nats.MsgId(msgID))
+	}
+	if lc.stream != "" {
+		opts = append(opts, nats.ExpectStream(lc.stream))
+	}
+
+	for retry := 0; ; retry++ {
+		// The message is rebuilt as publish sets the headers from the options
+		msg := &nats.Msg{Subject: topic, Data: []byte(conf.Body), Header: make(nats.Header, len(headers))}
+		for k, v := range headers {
+			msg.Header.Set(k, v)
+		}
+
+		_, err = lc.js.PublishMsg(msg, opts...)
+		if !isTimeout(err) || retry >= lc.retries {
+			return nil, err
+		}
+		log.Printf("[DEBUG] handler=jetstream topic=%s retry=%d ack timeout", topic, retry+1)
+	}
+}
+
+// isTimeout returns whether the publish timed out waiting for the ack
+func isTimeout(err error) bool {
+	return errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// jetStreamMsgID returns the msg_id option or the event id with a hash of the topic and body.
+// Every handler of a phase shares the event id so the hash keeps handlers publishing to one stream
+// from being deduplicated against each other.  Retries of a handler publish the same body so they
+// are still deduplicated.
+func jetStreamMsgID(event *types.Event, topic, body string, config types.Options) string {
+	if msgID, ok := config.GetString("msg_id"); ok && msgID != "" {
+		return msgID
+	}
+	if event.ID == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(topic + "\n" + body))
+	return fmt.Sprintf("%s:%x", event.ID, sum[:8])
+}
+
+// CloseConnection closes the nats connection.  Publishes are acknowledged synchronously so
+// nothing is pending.
+func (lc *JetStreamHandler) CloseConnection() error {
+	if lc.conn != nil {
+		lc.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+//go:build nats
+// +build nats
+
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/d3sw/floop/internal/natstest"
+	"github.com/d3sw/floop/types"
+)
+
+func Test_JetStreamHandler(t *testing.T) {
+	s, shutdown := natstest.RunServer(t)
+	defer shutdown()
+
+	conf := &types.HandlerConfig{
+		URI: s.ClientURL(),
+		Options: types.Options{
+			"topic":         "floop.events",
+			"stream":        "FLOOP",
+			"create_stream": true,
+			"subjects":      []interface{}{"floop.>"},
+			"storage":       "memory",
+			"headers":       map[interface{}]interface{}{"Floop-Event": "begin"},
+		},
+		Body: "foobar",
+	}
+
+	h := &JetStreamHandler{}
+	if err := h.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer h.CloseConnection()
+
+	// Same event twice is deduplicated by the server
+	event := &types.Event{ID: "event-1", Type: types.EventTypeBegin, Timestamp: time.Now().UnixNano()}
+	for i := 0; i < 2; i++ {
+		if _, err := h.Handle(event, conf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := h.js.StreamInfo("FLOOP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 1 {
+		t.Fatalf("messages=%d", info.State.Msgs)
+	}
+
+	sub, err := h.js.SubscribeSync("floop.events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Data) != "foobar" || msg.Header.Get("Floop-Event") != "begin" || !strings.HasPrefix(msg.Header.Get(nats.MsgIdHdr), "event-1:") {
+		t.Fatalf("header=%v data=%s", msg.Header, msg.Data)
+	}
+
+	// Expected stream mismatch is rejected
+	conf.Options["stream"] = "OTHER"
+	delete(conf.Options, "create_stream")
+	h2 := &JetStreamHandler{}
+	if err = h2.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer h2.CloseConnection()
+	if _, err = h2.Handle(&types.Event{ID: "event-2"}, conf); err == nil {
+		t.Fatal("should fail on wrong stream")
+	}
+}
+
+func Test_JetStreamHandler_SharedStream(t *testing.T) {
+	s, shutdown := natstest.RunServer(t)
+	defer shutdown()
+
+	newHandler := func(topic, body string) (*JetStreamHandler, *types.HandlerConfig) {
+		conf := &types.HandlerConfig{
+			URI: s.ClientURL(),
+			Options: types.Options{
+				"topic":         topic,
+				"stream":        "FLOOP",
+				"create_stream": true,
+				"subjects":      []interface{}{"floop.>"},
+				"storage":       "memory",
+			},
+			Body: body,
+		}
+		h := &JetStreamHandler{}
+		if err := h.Init(conf); err != nil {
+			t.Fatal(err)
+		}
+		return h, conf
+	}
+
+	h1, conf1 := newHandler("floop.status", "status")
+	defer h1.CloseConnection()
+	h2, conf2 := newHandler("floop.audit", "status")
+	defer h2.CloseConnection()
+	h3, conf3 := newHandler("floop.status", "audit")
+	defer h3.CloseConnection()
+
+	// Handlers of a phase share the event id
+	event := &types.Event{ID: "event-1", Type: types.EventTypeCompleted}
+	if _, err := h1.Handle(event, conf1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h2.Handle(event, conf2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h3.Handle(event, conf3); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := h1.js.StreamInfo("FLOOP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 3 {
+		t.Fatalf("messages=%d", info.State.Msgs)
+	}
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/d3sw/floop/types"
+)
+
+func Test_JetStreamHandler_TemplatedTopic(t *testing.T) {
+	conf := &types.HandlerConfig{
+		URI: "nats://127.0.0.1:1",
+		Options: types.Options{
+			"topic":         "floop.${Meta.refname}.begin",
+			"stream":        "FLOOP",
+			"create_stream": true,
+		},
+	}
+	// Fails before connecting
+	if err := (&JetStreamHandler{}).Init(conf); err == nil || !strings.Contains(err.Error(), "subjects required") {
+		t.Fatalf("should require subjects: %v", err)
+	}
+}
+
+func Test_jetStreamMsgID(t *testing.T) {
+	event := &types.Event{ID: "event-1"}
+	id := jetStreamMsgID(event, "floop.a", "status", types.Options{})
+	if !strings.HasPrefix(id, "event-1:") || id != jetStreamMsgID(event, "floop.a", "status", types.Options{}) {
+		t.Fatal(id)
+	}
+	// Handlers of a phase publishing to the same subject
+	if id == jetStreamMsgID(event, "floop.a", "audit", types.Options{}) || id == jetStreamMsgID(event, "floop.b", "status", types.Options{}) {
+		t.Fatal("ids should differ per topic and body")
+	}
+	if id := jetStreamMsgID(event, "floop.a", "status", types.Options{"msg_id": "job-1-begin"}); id != "job-1-begin" {
+		t.Fatal(id)
+	}
+	if id := jetStreamMsgID(&types.Event{}, "floop.a", "status", types.Options{}); id != "" {
+		t.Fatal(id)
+	}
+}
+
+func Test_isTimeout(t *testing.T) {
+	for _, err := range []error{nats.ErrTimeout, fmt.Errorf("publish: %w", nats.ErrTimeout), context.DeadlineExceeded} {
+		if !isTimeout(err) {
+			t.Fatalf("%v should be a timeout", err)
+		}
+	}
+	if isTimeout(nats.ErrNoResponders) || isTimeout(nil) {
+		t.Fatal("should not be a timeout")
+	}
+}
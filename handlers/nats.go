@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/d3sw/floop/types"
+	"github.com/nats-io/nats.go"
+)
+
+var (
+	dNatsMaxReconnect   = 10
+	dNatsReconnectWait  = 5 * time.Second
+	dNatsConnectTimeout = 1 * time.Second
+	dNatsFlushTimeout   = 5 * time.Second
+)
+
+// newNatsOptions returns the connection options for the uri from the handler options.  The uri
+// may be a comma separated list and additional cluster urls may be given as servers.
+//
+// Authentication is one of user/password, token, nkey_seed (seed file) or creds (credentials
+// file).  The tls block is the same as for the http handler.  These are rendered with Env and
+// Secret before Init.
+func newNatsOptions(uri string, config types.Options) (nats.Options, error) {
+	opts := nats.Options{
+		AllowReconnect: true,
+		MaxReconnect:   dNatsMaxReconnect,
+		ReconnectWait:  dNatsReconnectWait,
+		Timeout:        dNatsConnectTimeout,
+		Url:            uri,
+		AsyncErrorCB: func(conn *nats.Conn, sub *nats.Subscription, err error) {
+			log.Println("[ERROR]", err)
+		},
+	}
+
+	if servers, ok := config["servers"]; ok {
+		opts.Servers = optionStrings(servers)
+		if len(opts.Servers) == 0 {
+			return opts, fmt.Errorf("invalid servers %#v", servers)
+		}
+	}
+	if strings.Contains(uri, ",") {
+		for _, u := range strings.Split(uri, ",") {
+			opts.Servers = append(opts.Servers, strings.TrimSpace(u))
+		}
+		opts.Url = ""
+	}
+
+	opts.Name, _ = config.GetString("name")
+	opts.User, _ = config.GetString("user")
+	opts.Password, _ = config.GetString("password")
+	opts.Token, _ = config.GetString("token")
+
+	if seed, ok := config.GetString("nkey_seed"); ok && seed != "" {
+		opt, err := nats.NkeyOptionFromSeed(seed)
+		if err != nil {
+			return opts, err
+		}
+		if err = opt(&opts); err != nil {
+			return opts, err
+		}
+	}
+	if creds, ok := config.GetString("creds"); ok && creds != "" {
+		if err := nats.UserCredentials(creds)(&opts); err != nil {
+			return opts, err
+		}
+	}
+
+	tlsConf, err := newTLSConfig(config)
+	if err != nil {
+		return opts, err
+	}
+	if tlsConf != nil {
+		opts.Secure = true
+		opts.TLSConfig = tlsConf
+	}
+
+	if reconnect, ok := config.GetBool("reconnect"); ok {
+		opts.AllowReconnect = reconnect
+	}
+	if _, ok := config["max_reconnect"]; ok {
+		if opts.MaxReconnect, ok = config.GetInt("max_reconnect"); !ok {
+			return opts, fmt.Errorf("invalid max_reconnect %#v", config["max_reconnect"])
+		}
+	}
+	if _, ok := config["reconnect_wait"]; ok {
+		if opts.ReconnectWait, ok = config.GetDuration("reconnect_wait"); !ok {
+			return opts, fmt.Errorf("invalid reconnect_wait %#v", config["reconnect_wait"])
+		}
+	}
+	if _, ok := config["connect_timeout"]; ok {
+		if opts.Timeout, ok = config.GetDuration("connect_timeout"); !ok {
+			return opts, fmt.Errorf("invalid connect_timeout %#v", config["connect_timeout"])
+		}
+	}
+
+	return opts, nil
+}
+
+// NatsConnect connects to the uri with the same connection options as the nats handlers
+func NatsConnect(uri string, config types.Options) (*nats.Conn, error) {
+	opts, err := newNatsOptions(uri, config)
+	if err != nil {
+		return nil, err
+	}
+	return opts.Connect()
+}
+
+// natsFlushTimeout returns the flush_timeout option or the default
+func natsFlushTimeout(config types.Options) (time.Duration, error) {
+	if _, ok := config["flush_timeout"]; !ok {
+		return dNatsFlushTimeout, nil
+	}
+	d, ok := config.GetDuration("flush_timeout")
+	if !ok || d <= 0 {
+		return 0, fmt.Errorf("invalid flush_timeout %#v", config["flush_timeout"])
+	}
+	return d, nil
+}
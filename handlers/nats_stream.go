@@ -3,20 +3,45 @@ package handlers
 import (
 	"errors"
 	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/d3sw/floop/types"
 	//"github.com/nats-io/go-nats"
 	stan "github.com/nats-io/go-nats-streaming"
 )
 
+var (
+	dStanPingInterval = 5
+	dStanPingMaxOut   = 3
+)
+
 // NatsStreamdHandler is handler to publish lifecycle events to NatsStream
 type NatsStreamdHandler struct {
 	conf *types.HandlerConfig
-	// Nats connection
-	conn stan.Conn
+
+	clusterID string
+	// Generated client id used when none is configured
+	uniqueID string
+	opts     []stan.Option
+
+	// Publish asynchronously tracking acks.  Close waits for outstanding acks
+	async        bool
+	pending      sync.WaitGroup
+	flushTimeout time.Duration
+
+	mu sync.Mutex
+	// Nats connection.  nil until the first event if the client id is templated or after the
+	// connection is lost
+	conn   stan.Conn
+	ackErr error // last async ack error
 }
 
-// Init initializes the connection to the NatsStream cluster
+// Init initializes the connection to the NatsStream cluster.  If the client id is templated the
+// connection is made on the first event.  Without a client id a unique one is generated so
+// multiple instances can run at once.
 func (lc *NatsStreamdHandler) Init(conf *types.HandlerConfig) error {
 	lc.conf = conf
 
@@ -24,18 +49,120 @@ func (lc *NatsStreamdHandler) Init(conf *types.HandlerConfig) error {
 	if !ok || clusterID == "" {
 		return errors.New("cluster_id required")
 	}
-	clientID, ok := lc.conf.Options.GetString("client_id")
-	if !ok || clientID == "" {
-		return errors.New("client_id required")
+	lc.clusterID = clusterID
+	lc.uniqueID = "floop-" + strings.Replace(types.NewID(), "-", "", -1)
+
+	var err error
+	if lc.opts, err = newStanOptions(conf.URI, conf.Options); err != nil {
+		return err
+	}
+	if lc.flushTimeout, err = natsFlushTimeout(conf.Options); err != nil {
+		return err
 	}
+	lc.async, _ = conf.Options.GetBool("async")
 
-	conn, err := stan.Connect(clusterID, clientID, stan.NatsURL(conf.URI))
-	if err == nil {
-		lc.conn = conn
+	clientID, _ := lc.conf.Options.GetString("client_id")
+	if IsTemplated(clientID) {
+		return nil
 	}
+	_, err = lc.connect(clientID)
 	return err
 }
 
+// newStanOptions returns the connection options from the handler options
+func newStanOptions(uri string, config types.Options) ([]stan.Option, error) {
+	opts := []stan.Option{stan.NatsURL(uri)}
+
+	if _, ok := config["connect_wait"]; ok {
+		d, ok := config.GetDuration("connect_wait")
+		if !ok {
+			return nil, fmt.Errorf("invalid connect_wait %#v", config["connect_wait"])
+		}
+		opts = append(opts, stan.ConnectWait(d))
+	}
+	if _, ok := config["ack_timeout"]; ok {
+		d, ok := config.GetDuration("ack_timeout")
+		if !ok {
+			return nil, fmt.Errorf("invalid ack_timeout %#v", config["ack_timeout"])
+		}
+		opts = append(opts, stan.PubAckWait(d))
+	}
+	if _, ok := config["max_inflight"]; ok {
+		max, ok := config.GetInt("max_inflight")
+		if !ok || max <= 0 {
+			return nil, fmt.Errorf("invalid max_inflight %#v", config["max_inflight"])
+		}
+		opts = append(opts, stan.MaxPubAcksInflight(max))
+	}
+
+	interval, hasInterval := config.GetInt("ping_interval")
+	maxOut, hasMaxOut := config.GetInt("ping_max_out")
+	if hasInterval || hasMaxOut {
+		if !hasInterval {
+			interval = dStanPingInterval
+		}
+		if !hasMaxOut {
+			maxOut = dStanPingMaxOut
+		}
+		if interval <= 0 || maxOut <= 0 {
+			return nil, fmt.Errorf("invalid ping_interval/ping_max_out %d/%d", interval, maxOut)
+		}
+		opts = append(opts, stan.Pings(interval, maxOut))
+	}
+
+	return opts, nil
+}
+
+// IsTemplated returns whether a raw option value contains template directives
+func IsTemplated(s string) bool {
+	return strings.Contains(s, "${") || strings.Contains(s, "{{")
+}
+
+// connect returns the current connection or connects with the client id
+func (lc *NatsStreamdHandler) connect(clientID string) (stan.Conn, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.conn != nil {
+		return lc.conn, nil
+	}
+	if clientID == "" {
+		clientID = lc.uniqueID
+	}
+
+	opts := append([]stan.Option{stan.SetConnectionLostHandler(lc.connectionLost)}, lc.opts...)
+	conn, err := stan.Connect(lc.clusterID, clientID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[INFO] handler=nats-stream connected cluster=%s client=%s", lc.clusterID, clientID)
+
+	lc.conn = conn
+	return conn, nil
+}
+
+// connectionLost is called when the streaming server stops responding to pings.  The connection
+// is re-established on the next event.
+func (lc *NatsStreamdHandler) connectionLost(conn stan.Conn, err error) {
+	log.Printf("[ERROR] handler=nats-stream connection lost: %v", err)
+
+	lc.mu.Lock()
+	if lc.conn == conn {
+		lc.conn = nil
+	}
+	lc.mu.Unlock()
+}
+
+func (lc *NatsStreamdHandler) ackHandler(guid string, err error) {
+	if err != nil {
+		log.Printf("[ERROR] handler=nats-stream guid=%s %v", guid, err)
+		lc.mu.Lock()
+		lc.ackErr = err
+		lc.mu.Unlock()
+	}
+	lc.pending.Done()
+}
+
 // Handle publishes to NatsStream.  The config is the normalized
 // config built using data from the child process.  This may be different from the one
 // used in Init
@@ -48,14 +175,49 @@ func (lc *NatsStreamdHandler) Handle(event *types.Event, conf *types.HandlerConf
 
 	fmt.Printf("[nats-stream] phase=%s topic=%s %+v\n", event.Type, topic, event.Data)
 
-	// Publish the body as bytes
-	err := lc.conn.Publish(topic, []byte(conf.Body))
+	clientID, _ := conf.Options.GetString("client_id")
+	conn, err := lc.connect(clientID)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil, err
+	if !lc.async {
+		// Publish the body as bytes
+		return nil, conn.Publish(topic, []byte(conf.Body))
+	}
+
+	lc.pending.Add(1)
+	if _, err = conn.PublishAsync(topic, []byte(conf.Body), lc.ackHandler); err != nil {
+		lc.pending.Done()
+		return nil, err
+	}
+	return nil, nil
 }
 
-// CloseConnection closes the nats stream connection
+// CloseConnection waits for outstanding acks and closes the nats stream connection
 func (lc *NatsStreamdHandler) CloseConnection() error {
-	lc.conn.Close()
-	return nil
+	done := make(chan struct{})
+	go func() {
+		lc.pending.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-time.After(lc.flushTimeout):
+		err = errors.New("timed out waiting for acks")
+	}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if err == nil {
+		err = lc.ackErr
+	}
+	if lc.conn != nil {
+		lc.conn.Close()
+		lc.conn = nil
+	}
+	return err
 }
@@ -5,7 +5,7 @@ import (
 	"time"
 
 	"github.com/d3sw/floop/types"
-	"github.com/nats-io/go-nats"
+	"github.com/nats-io/nats.go"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -37,3 +37,55 @@ func Test_NatsStreamHandler(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func Test_NatsStreamHandler_Async(t *testing.T) {
+	conf := &types.HandlerConfig{
+		URI: nats.DefaultURL,
+		Options: types.Options{
+			"client_id":    "floop-${RunID}",
+			"cluster_id":   "clusterID",
+			"topic":        "test",
+			"async":        true,
+			"max_inflight": 16,
+		},
+		Body: "foobar",
+	}
+
+	h := &NatsStreamdHandler{}
+	if err := h.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if h.conn != nil {
+		t.Fatal("templated client id should connect on the first event")
+	}
+
+	conf.Options["client_id"] = "floop-run1"
+	for i := 0; i < 10; i++ {
+		if _, err := h.Handle(&types.Event{Type: types.EventTypeProgress}, conf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Waits for all acks
+	assert.Nil(t, h.CloseConnection())
+}
+
+func Test_newStanOptions(t *testing.T) {
+	opts, err := newStanOptions(nats.DefaultURL, types.Options{
+		"ack_timeout":   "10s",
+		"max_inflight":  16,
+		"ping_interval": 2,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(opts))
+
+	for _, config := range []types.Options{
+		{"max_inflight": 0},
+		{"ack_timeout": "soon"},
+		{"ping_max_out": -1},
+	} {
+		if _, err = newStanOptions(nats.DefaultURL, config); err == nil {
+			t.Fatalf("should fail: %v", config)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/d3sw/floop/types"
+)
+
+func Test_newNatsOptions(t *testing.T) {
+	opts, err := newNatsOptions("nats://a:4222, nats://b:4222", types.Options{
+		"name":           "floop",
+		"user":           "user",
+		"password":       "pass",
+		"max_reconnect":  3,
+		"reconnect_wait": "500ms",
+		"tls":            map[interface{}]interface{}{"server_name": "nats.internal"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.Url != "" || len(opts.Servers) != 2 || opts.Servers[1] != "nats://b:4222" {
+		t.Fatalf("url=%s servers=%v", opts.Url, opts.Servers)
+	}
+	if opts.Name != "floop" || opts.User != "user" || opts.Password != "pass" {
+		t.Fatalf("%+v", opts)
+	}
+	if opts.MaxReconnect != 3 || opts.ReconnectWait != 500*time.Millisecond || opts.Timeout != dNatsConnectTimeout {
+		t.Fatalf("reconnect=%d wait=%v timeout=%v", opts.MaxReconnect, opts.ReconnectWait, opts.Timeout)
+	}
+	if !opts.Secure || opts.TLSConfig.ServerName != "nats.internal" {
+		t.Fatal("tls not set")
+	}
+
+	for _, config := range []types.Options{
+		{"nkey_seed": "/does/not/exist"},
+		{"max_reconnect": "many"},
+		{"servers": 1},
+	} {
+		if _, err = newNatsOptions("nats://localhost:4222", config); err == nil {
+			t.Fatalf("should fail: %v", config)
+		}
+	}
+
+	if _, err = natsFlushTimeout(types.Options{"flush_timeout": 0}); err == nil {
+		t.Fatal("should fail on zero flush_timeout")
+	}
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/d3sw/floop/types"
+)
+
+// newTLSConfig builds a tls config from the tls block of the handler options.  It returns nil if
+// the block is not specified.  ca_file is added to the system pool and cert_file/key_file are the
+// client certificate for mutual tls.
+func newTLSConfig(config types.Options) (*tls.Config, error) {
+	if _, ok := config["tls"]; !ok {
+		return nil, nil
+	}
+	opts, ok := config.GetOptions("tls")
+	if !ok {
+		return nil, fmt.Errorf("invalid tls data type %#v", config["tls"])
+	}
+
+	tlsConf := &tls.Config{}
+	tlsConf.ServerName, _ = opts.GetString("server_name")
+	tlsConf.InsecureSkipVerify, _ = opts.GetBool("insecure_skip_verify")
+
+	if caFile, ok := opts.GetString("ca_file"); ok && caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConf.RootCAs = pool
+	}
+
+	certFile, _ := opts.GetString("cert_file")
+	keyFile, _ := opts.GetString("key_file")
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("tls cert_file and key_file must both be set")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConf, nil
+}
@@ -0,0 +1,38 @@
+//go:build nats
+// +build nats
+
+// Package natstest runs an embedded nats server for tests.  It is only built with the nats tag as
+// it requires github.com/nats-io/nats-server/v2 e.g. make test-nats.
+package natstest
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// RunServer starts an embedded nats server with JetStream enabled on a random port.  The returned
+// func shuts it down and removes its store.
+func RunServer(t *testing.T) (*server.Server, func()) {
+	dir, err := ioutil.TempDir("", "floop-nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+
+	return s, func() {
+		s.Shutdown()
+		os.RemoveAll(dir)
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"time"
 
 	"plugin"
+	"sync"
+	"sync/atomic"
 
 	"github.com/d3sw/floop/handlers"
 	"github.com/d3sw/floop/resolver"
@@ -20,9 +22,19 @@ var (
 
 // Lifecycle implements a Lifecycle that calls multiple lifecycles for an event.
 type Lifecycle struct {
+	seq uint64 // last event sequence number.  First for 64-bit alignment as it is accessed atomically
+
 	ctx          *types.Context
 	handlers     map[types.EventType][]*phaseHandler
 	addrResolver *resolver.Resolver
+	vars         *templateVars // env and secrets available to templates
+
+	runID  string // unique id of this run
+	shared bool   // handlers are owned by the lifecycle this run was created from
+
+	mu           sync.Mutex
+	phase        types.EventType // current phase
+	lastProgress []byte          // last progress line
 }
 
 // NewLifecycle instantiates an instance of Lifecycle
@@ -41,12 +53,25 @@ func NewLifecycle(conf *Config) (*Lifecycle, error) {
 	lc := &Lifecycle{
 		handlers:     make(map[types.EventType][]*phaseHandler),
 		addrResolver: resolver.NewResolver(rPort, rHosts...),
+		runID:        types.NewID(),
 	}
 	if conf == nil {
 		return lc, nil
 	}
 
-	err := lc.loadHandlers(conf)
+	secretsDir := conf.SecretsDir
+	if secretsDir == "" {
+		secretsDir = dSecretsDir
+	}
+	secrets, err := loadSecrets(secretsDir)
+	if err != nil {
+		return nil, err
+	}
+	// Secrets should never show up in the logs
+	maskLogOutput(secrets)
+	lc.vars = newTemplateVars(secrets)
+
+	err = lc.loadHandlers(conf)
 	return lc, err
 }
 
@@ -71,9 +96,16 @@ func (lc *Lifecycle) loadHandlers(conf *Config) error {
 				}
 
 				var backoff handlers.Backoff
-				if _backoff, ok := config.Options["backoff"]; ok && _backoff == "linear" {
+				switch _backoff, _ := config.Options.GetString("backoff"); _backoff {
+				case "linear":
 					backoff = handlers.LinearBackoff{Interval: time.Duration(interval) * time.Second}
-				} else {
+				case "exponential":
+					maxInterval, _ := config.Options.GetInt("max_interval")
+					backoff = handlers.ExponentialBackoff{
+						Interval: time.Duration(interval) * time.Second,
+						Max:      time.Duration(maxInterval) * time.Second,
+					}
+				default:
 					backoff = handlers.ConstantBackoff{Interval: time.Duration(interval) * time.Second}
 				}
 
@@ -82,6 +114,8 @@ func (lc *Lifecycle) loadHandlers(conf *Config) error {
 				handler = &handlers.EchoHandler{}
 			case "gnatsd":
 				handler = &handlers.GnatsdHandler{}
+			case "jetstream":
+				handler = &handlers.JetStreamHandler{}
 			case "nats-stream":
 				handler = &handlers.NatsStreamdHandler{}
 			case "plug-in":
@@ -130,41 +164,88 @@ func (lc *Lifecycle) loadPluginHandler(conf *types.HandlerConfig) (Handler, erro
 
 // Register registers a new Handler by an arbitrary name.
 func (lc *Lifecycle) register(eventType types.EventType, l Handler, conf *types.HandlerConfig) error {
-	if err := l.Init(conf); err != nil {
+	// Parse templates before Init so config errors are reported before connecting
+	ph, err := newPhaseHandler(l, conf, lc.vars)
+	if err != nil {
+		return fmt.Errorf("phase=%s handler=%s %v", eventType, conf.Type, err)
+	}
+
+	// Credentials and tls files may come from the environment or secrets
+	opts, err := renderOptions(conf, conf.Options, initOptionKeys, lc.vars)
+	if err != nil {
+		return fmt.Errorf("phase=%s handler=%s %v", eventType, conf.Type, err)
+	}
+	initConf := conf.Clone()
+	initConf.Options = opts
+
+	if err := l.Init(initConf); err != nil {
 		return err
 	}
 
 	arr, ok := lc.handlers[eventType]
 	if !ok {
-		lc.handlers[eventType] = []*phaseHandler{&phaseHandler{Handler: l, conf: conf}}
+		lc.handlers[eventType] = []*phaseHandler{ph}
 	} else {
-		lc.handlers[eventType] = append(arr, &phaseHandler{Handler: l, conf: conf})
+		lc.handlers[eventType] = append(arr, ph)
 	}
 
 	return nil
 }
 
+// newRun returns a lifecycle for another run with the same handlers.  Only per-run state is new so
+// handlers are not reconnected for each run.  Closing it flushes the handlers without closing them.
+func (lc *Lifecycle) newRun() *Lifecycle {
+	run := &Lifecycle{
+		handlers:     make(map[types.EventType][]*phaseHandler, len(lc.handlers)),
+		addrResolver: lc.addrResolver,
+		vars:         lc.vars,
+		runID:        types.NewID(),
+		shared:       true,
+	}
+	for eventType, handlers := range lc.handlers {
+		for _, v := range handlers {
+			run.handlers[eventType] = append(run.handlers[eventType], v.newRun())
+		}
+	}
+	return run
+}
+
+// RunID returns the unique id of this run
+func (lc *Lifecycle) RunID() string {
+	return lc.runID
+}
+
+// Status returns the current phase and the last progress line
+func (lc *Lifecycle) Status() (types.EventType, []byte) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	// Copied as Progress reuses the slice
+	return lc.phase, append([]byte(nil), lc.lastProgress...)
+}
+
+func (lc *Lifecycle) setPhase(phase types.EventType) {
+	lc.mu.Lock()
+	lc.phase = phase
+	lc.mu.Unlock()
+}
+
 // Begin is called right before a process is launched.  The context is internally stored and may be
 // updated by subsequent phases from callback responses.
 func (lc *Lifecycle) Begin(ctx *types.Context) error {
 	lc.ctx = ctx
+	lc.setPhase(types.EventTypeBegin)
 
 	handlers, ok := lc.handlers[types.EventTypeBegin]
 	if !ok || handlers == nil || len(handlers) == 0 {
 		return nil
 	}
 
+	base := lc.newEvent(types.EventTypeBegin, nil)
 	for _, v := range handlers {
-		event := &types.Event{
-			Type:      types.EventTypeBegin,
-			Meta:      ctx.Meta,
-			Timestamp: time.Now().UnixNano(),
-		}
-
-		meta, err := v.Handle(event)
+		meta, err := handleEvent(v, base)
 		if err != nil {
 			if v.conf.IgnoreErrors {
-				log.Printf("[ERROR] phase=%s handler=%s %v", event.Type, v.conf.Type, err)
+				log.Printf("[ERROR] phase=%s handler=%s %v", base.Type, v.conf.Type, err)
 				continue
 			}
 			return err
@@ -179,99 +260,104 @@ func (lc *Lifecycle) Begin(ctx *types.Context) error {
 // Progress echos the progress payload
 func (lc *Lifecycle) Progress(line []byte) {
 	//fmt.Printf("[Progress] %s", line)
+	lc.mu.Lock()
+	lc.phase = types.EventTypeProgress
+	lc.lastProgress = append(lc.lastProgress[:0], line...)
+	lc.mu.Unlock()
+
 	handlers, ok := lc.handlers[types.EventTypeProgress]
 	if !ok || handlers == nil || len(handlers) == 0 {
 		return
 	}
 
-	for _, v := range handlers {
-		event := &types.Event{
-			Type:      types.EventTypeProgress,
-			Meta:      lc.ctx.Meta,
-			Data:      line,
-			Timestamp: time.Now().UnixNano(),
-		}
-		if _, err := v.Handle(event); err != nil {
-			log.Printf("[ERROR] phase=%s handler=%s %v", event.Type, v.conf.Type, err)
-		}
-	}
+	lc.dispatch(handlers, lc.newEvent(types.EventTypeProgress, line))
 }
 
 // Failed is called if the process exits with a non-zero exit status. Data from stderr and stdout
 // are passed in as args
 func (lc *Lifecycle) Failed(result *types.ChildResult) {
+	lc.setPhase(types.EventTypeFailed)
+	lc.flushProgress()
 
 	handlers, ok := lc.handlers[types.EventTypeFailed]
 	if !ok || handlers == nil || len(handlers) == 0 {
 		return
 	}
 
-	for _, v := range handlers {
-
-		event := &types.Event{
-			Type:      types.EventTypeFailed,
-			Meta:      lc.ctx.Meta,
-			Data:      result,
-			Timestamp: time.Now().UnixNano(),
-		}
-
-		if _, err := v.Handle(event); err != nil {
-			log.Printf("[ERROR] phase=%s handler=%s %v", event.Type, v.conf.Type, err)
-		}
-
-	}
+	base := lc.newEvent(types.EventTypeFailed, result)
+	base.Result = result
+	lc.dispatch(handlers, base)
 }
 
 // Canceled is called if the process was interrupted or killed. Data from stderr and stdout
 // are passed in as args
 func (lc *Lifecycle) Canceled(result *types.ChildResult) {
 	log.Println("[DEBUG] In Canceled")
+	lc.setPhase(types.EventTypeCanceled)
+	lc.flushProgress()
+
 	handlers, ok := lc.handlers[types.EventTypeCanceled]
 	if !ok || handlers == nil || len(handlers) == 0 {
 		return
 	}
 
-	for _, v := range handlers {
-
-		event := &types.Event{
-			Type:      types.EventTypeCanceled,
-			Meta:      lc.ctx.Meta,
-			Data:      result,
-			Timestamp: time.Now().UnixNano(),
-		}
-
-		if _, err := v.Handle(event); err != nil {
-			log.Printf("[ERROR] phase=%s handler=%s %v", event.Type, v.conf.Type, err)
-		}
-
-	}
+	base := lc.newEvent(types.EventTypeCanceled, result)
+	base.Result = result
+	lc.dispatch(handlers, base)
 }
 
 // Completed is called when a process completes with a zero exit code. Data from stderr and stdout
 // are passed in as args
 func (lc *Lifecycle) Completed(result *types.ChildResult) {
+	lc.setPhase(types.EventTypeCompleted)
+	lc.flushProgress()
+
 	handlers, ok := lc.handlers[types.EventTypeCompleted]
 	if !ok || handlers == nil || len(handlers) == 0 {
 		return
 	}
 
-	for _, v := range handlers {
+	base := lc.newEvent(types.EventTypeCompleted, result.Stdout)
+	base.Result = result
+	lc.dispatch(handlers, base)
+}
 
-		event := &types.Event{
-			Type:      types.EventTypeCompleted,
-			Meta:      lc.ctx.Meta,
-			Data:      result.Stdout,
-			Timestamp: time.Now().UnixNano(),
+// dispatch calls each handler with the event logging any errors
+func (lc *Lifecycle) dispatch(handlers []*phaseHandler, base *types.Event) {
+	for _, v := range handlers {
+		if _, err := handleEvent(v, base); err != nil {
+			log.Printf("[ERROR] phase=%s handler=%s %v", base.Type, v.conf.Type, err)
 		}
+	}
+}
 
-		//if !v.applyTransform(result.Stdout, event) {
-		//	event.Data = result.Stdout
-		//}
+// handleEvent calls the handler with its own copy of the event as transforms replace the data
+func handleEvent(v *phaseHandler, base *types.Event) (map[string]interface{}, error) {
+	event := *base
+	return v.Handle(&event)
+}
 
-		if _, err := v.Handle(event); err != nil {
-			log.Printf("[ERROR] phase=%s handler=%s %v", event.Type, v.conf.Type, err)
+// flushProgress flushes progress handlers that buffer events
+func (lc *Lifecycle) flushProgress() {
+	for _, v := range lc.handlers[types.EventTypeProgress] {
+		if f, ok := v.Handler.(Flusher); ok {
+			if err := f.Flush(); err != nil {
+				log.Printf("[ERROR] phase=%s handler=%s %v", types.EventTypeProgress, v.conf.Type, err)
+			}
 		}
+	}
+}
 
+// newEvent returns an event with a new id and the next sequence number in the run
+func (lc *Lifecycle) newEvent(eventType types.EventType, data interface{}) *types.Event {
+	return &types.Event{
+		ID:        types.NewID(),
+		RunID:     lc.runID,
+		Seq:       atomic.AddUint64(&lc.seq, 1),
+		Type:      eventType,
+		Meta:      lc.ctx.Meta,
+		Data:      data,
+		Timestamp: time.Now().UnixNano(),
 	}
 }
 
@@ -292,20 +378,21 @@ func (lc *Lifecycle) applyContext(meta map[string]interface{}, conf *types.Handl
 
 }
 
-// Close - close completed and failed handlers so the last event is published
+// Close flushes and closes the handlers of every phase so pending events are published before the
+// app terminates.  A run sharing its handlers only flushes them.
 func (lc *Lifecycle) Close() {
-	handlers, ok := lc.handlers[types.EventTypeCompleted]
-	if ok && handlers != nil && len(handlers) != 0 {
-		for _, v := range handlers {
-			v.CloseConnection()
-		}
+	lc.flushProgress()
+	if lc.shared {
+		return
 	}
 
-	handlers, ok = lc.handlers[types.EventTypeFailed]
-	if ok && handlers != nil && len(handlers) != 0 {
-		for _, v := range handlers {
-			v.CloseConnection()
+	for _, eventType := range []types.EventType{types.EventTypeBegin, types.EventTypeProgress,
+		types.EventTypeCompleted, types.EventTypeFailed, types.EventTypeCanceled} {
+
+		for _, v := range lc.handlers[eventType] {
+			if err := v.CloseConnection(); err != nil {
+				log.Printf("[ERROR] phase=%s handler=%s %v", eventType, v.conf.Type, err)
+			}
 		}
 	}
-
 }
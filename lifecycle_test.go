@@ -0,0 +1,238 @@
+package floop
+
+import (
+	"os"
+	"testing"
+
+	"github.com/d3sw/floop/types"
+)
+
+// testHandler records the events and normalized configs it handles
+type testHandler struct {
+	events []*types.Event
+	confs  []*types.HandlerConfig
+}
+
+func (h *testHandler) Init(*types.HandlerConfig) error { return nil }
+
+func (h *testHandler) Handle(event *types.Event, conf *types.HandlerConfig) (map[string]interface{}, error) {
+	h.events = append(h.events, event)
+	h.confs = append(h.confs, conf)
+	return nil, nil
+}
+
+func (h *testHandler) CloseConnection() error { return nil }
+
+func Test_Lifecycle_EventIDs(t *testing.T) {
+	lc, err := NewLifecycle(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &testHandler{}
+	conf := &types.HandlerConfig{Type: "test", Body: "${RunID} ${EventID} ${Seq}"}
+	for _, eventType := range []types.EventType{types.EventTypeBegin, types.EventTypeProgress, types.EventTypeCompleted} {
+		if err = lc.register(eventType, h, conf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = lc.Begin(&types.Context{Meta: map[string]interface{}{}}); err != nil {
+		t.Fatal(err)
+	}
+	lc.Progress([]byte("line\n"))
+	lc.Completed(&types.ChildResult{})
+
+	if len(h.events) != 3 {
+		t.Fatalf("events: %d", len(h.events))
+	}
+	ids := map[string]bool{}
+	for i, event := range h.events {
+		if event.RunID != lc.RunID() || event.Seq != uint64(i+1) {
+			t.Fatalf("event %d: run=%s seq=%d", i, event.RunID, event.Seq)
+		}
+		if event.ID == "" || ids[event.ID] {
+			t.Fatalf("event %d: id not unique %q", i, event.ID)
+		}
+		ids[event.ID] = true
+	}
+
+	if expected := lc.RunID() + " " + h.events[1].ID + " 2"; h.confs[1].Body != expected {
+		t.Fatalf("body: %s", h.confs[1].Body)
+	}
+}
+
+// flushHandler records the number of events pending when flushed
+type flushHandler struct {
+	testHandler
+	pending int
+	flushed []int
+}
+
+func (h *flushHandler) Handle(event *types.Event, conf *types.HandlerConfig) (map[string]interface{}, error) {
+	h.pending++
+	return h.testHandler.Handle(event, conf)
+}
+
+func (h *flushHandler) Flush() error {
+	h.flushed = append(h.flushed, h.pending)
+	h.pending = 0
+	return nil
+}
+
+func Test_Lifecycle_FlushProgress(t *testing.T) {
+	lc, err := NewLifecycle(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	progress := &flushHandler{}
+	if err = lc.register(types.EventTypeProgress, progress, &types.HandlerConfig{Type: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	completed := &testHandler{}
+	if err = lc.register(types.EventTypeCompleted, completed, &types.HandlerConfig{Type: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	lc.ctx = &types.Context{Meta: map[string]interface{}{}}
+	lc.Progress([]byte("1\n"))
+	lc.Progress([]byte("2\n"))
+	lc.Completed(&types.ChildResult{})
+
+	if len(progress.flushed) != 1 || progress.flushed[0] != 2 || len(completed.events) != 1 {
+		t.Fatalf("flushed=%v completed=%d", progress.flushed, len(completed.events))
+	}
+}
+
+// closeHandler counts the times it is closed
+type closeHandler struct {
+	testHandler
+	closed int
+}
+
+func (h *closeHandler) CloseConnection() error {
+	h.closed++
+	return nil
+}
+
+func Test_Lifecycle_Close(t *testing.T) {
+	lc, err := NewLifecycle(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hs []*closeHandler
+	for _, eventType := range []types.EventType{types.EventTypeBegin, types.EventTypeProgress,
+		types.EventTypeCompleted, types.EventTypeFailed, types.EventTypeCanceled} {
+
+		h := &closeHandler{}
+		if err = lc.register(eventType, h, &types.HandlerConfig{Type: "test"}); err != nil {
+			t.Fatal(err)
+		}
+		hs = append(hs, h)
+	}
+
+	lc.Close()
+	for i, h := range hs {
+		if h.closed != 1 {
+			t.Fatalf("handler %d closed %d times", i, h.closed)
+		}
+	}
+}
+
+func Test_Lifecycle_NewRun(t *testing.T) {
+	lc, err := NewLifecycle(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &closeHandler{}
+	conf := &types.HandlerConfig{Type: "test", Estimate: &types.EstimateConfig{Current: "frame", Total: "frames"}}
+	if err = lc.register(types.EventTypeCompleted, h, conf); err != nil {
+		t.Fatal(err)
+	}
+
+	run := lc.newRun()
+	run.ctx = &types.Context{Meta: map[string]interface{}{}}
+	run.Completed(&types.ChildResult{})
+	run.Close()
+
+	if run.RunID() == lc.RunID() || len(h.events) != 1 || h.events[0].RunID != run.RunID() || h.events[0].Seq != 1 {
+		t.Fatalf("run=%s events=%+v", run.RunID(), h.events)
+	}
+	if run.handlers[types.EventTypeCompleted][0].estimator == lc.handlers[types.EventTypeCompleted][0].estimator {
+		t.Fatal("estimator shared by runs")
+	}
+	// The handlers stay open for the next run
+	if h.closed != 0 {
+		t.Fatalf("closed %d times", h.closed)
+	}
+	lc.Close()
+	if h.closed != 1 {
+		t.Fatalf("closed %d times", h.closed)
+	}
+}
+
+func Test_Lifecycle_Status(t *testing.T) {
+	lc, err := NewLifecycle(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lc.Progress([]byte("frame=1\n"))
+	phase, progress := lc.Status()
+	lc.Progress([]byte("frame=2\n"))
+
+	// The returned line is not overwritten by later progress
+	if phase != types.EventTypeProgress || string(progress) != "frame=1\n" {
+		t.Fatalf("phase=%s progress=%q", phase, progress)
+	}
+}
+
+type initHandler struct {
+	testHandler
+	conf *types.HandlerConfig
+}
+
+func (h *initHandler) Init(conf *types.HandlerConfig) error {
+	h.conf = conf
+	return nil
+}
+
+func Test_Lifecycle_RenderInitOptions(t *testing.T) {
+	os.Setenv("FLOOP_TEST_NATS_USER", "floop")
+	defer os.Unsetenv("FLOOP_TEST_NATS_USER")
+
+	lc, err := NewLifecycle(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc.vars = newTemplateVars(map[string]string{"nats_password": "s3cret"})
+
+	conf := &types.HandlerConfig{
+		Type: "test",
+		Options: types.Options{
+			"topic":    "floop.${Meta.refname}",
+			"user":     "${Env.FLOOP_TEST_NATS_USER}",
+			"password": "${Secret.nats_password}",
+			"tls":      map[interface{}]interface{}{"ca_file": "${Env.FLOOP_TEST_NATS_USER}.pem"},
+		},
+	}
+	h := &initHandler{}
+	if err = lc.register(types.EventTypeBegin, h, conf); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := h.conf.Options
+	if opts["user"] != "floop" || opts["password"] != "s3cret" || opts["topic"] != "floop.${Meta.refname}" {
+		t.Fatalf("options: %+v", opts)
+	}
+	if tls, _ := opts.GetOptions("tls"); tls["ca_file"] != "floop.pem" {
+		t.Fatalf("tls: %+v", opts["tls"])
+	}
+	// The config is left as is for the per event templates
+	if conf.Options["password"] != "${Secret.nats_password}" {
+		t.Fatalf("config changed: %+v", conf.Options)
+	}
+}
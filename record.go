@@ -0,0 +1,141 @@
+package floop
+
+import (
+	"bytes"
+	"regexp"
+	"sync"
+
+	"github.com/d3sw/floop/types"
+)
+
+// recordAssembler groups lines of output into records before calling the progress callback
+type recordAssembler struct {
+	mode     string
+	start    *regexp.Regexp
+	end      *regexp.Regexp
+	callback func([]byte)
+
+	mtx sync.Mutex
+	buf []byte
+
+	// json mode brace tracking
+	depth    int
+	inString bool
+	escaped  bool
+}
+
+func newRecordAssembler(conf *types.RecordConfig, cb func([]byte)) (*recordAssembler, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	ra := &recordAssembler{mode: conf.Mode, callback: cb}
+	if ra.callback == nil {
+		ra.callback = func([]byte) {}
+	}
+
+	var err error
+	if conf.Start != "" {
+		if ra.start, err = regexp.Compile(conf.Start); err != nil {
+			return nil, err
+		}
+	}
+	if conf.End != "" {
+		if ra.end, err = regexp.Compile(conf.End); err != nil {
+			return nil, err
+		}
+	}
+
+	return ra, nil
+}
+
+// Write takes one or more new line terminated lines and issues a callback for each completed
+// record.
+func (ra *recordAssembler) Write(b []byte) {
+	ra.mtx.Lock()
+	defer ra.mtx.Unlock()
+
+	for len(b) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line, b = b[:i+1], b[i+1:]
+		} else {
+			line, b = b, nil
+		}
+
+		switch ra.mode {
+		case "regex":
+			ra.writeRegex(line)
+		case "blank":
+			ra.writeBlank(line)
+		case "json":
+			ra.writeJSON(line)
+		}
+	}
+}
+
+// Flush issues a callback with any partially assembled record
+func (ra *recordAssembler) Flush() {
+	ra.mtx.Lock()
+	defer ra.mtx.Unlock()
+	ra.flush()
+}
+
+func (ra *recordAssembler) writeRegex(line []byte) {
+	trimmed := bytes.TrimRight(line, "\r\n")
+	if ra.start != nil && ra.start.Match(trimmed) {
+		ra.flush()
+	}
+
+	ra.buf = append(ra.buf, line...)
+
+	if ra.end != nil && ra.end.Match(trimmed) {
+		ra.flush()
+	}
+}
+
+func (ra *recordAssembler) writeBlank(line []byte) {
+	if len(bytes.TrimSpace(line)) == 0 {
+		ra.flush()
+		return
+	}
+	ra.buf = append(ra.buf, line...)
+}
+
+// writeJSON tracks braces and brackets outside of strings and flushes once they are balanced.
+// Lines outside of any object are issued as their own record.
+func (ra *recordAssembler) writeJSON(line []byte) {
+	for _, c := range line {
+		switch {
+		case ra.escaped:
+			ra.escaped = false
+		case ra.inString:
+			if c == '\\' {
+				ra.escaped = true
+			} else if c == '"' {
+				ra.inString = false
+			}
+		case c == '"':
+			ra.inString = true
+		case c == '{' || c == '[':
+			ra.depth++
+		case c == '}' || c == ']':
+			if ra.depth > 0 {
+				ra.depth--
+			}
+		}
+	}
+
+	ra.buf = append(ra.buf, line...)
+	if ra.depth == 0 {
+		ra.inString = false
+		ra.flush()
+	}
+}
+
+func (ra *recordAssembler) flush() {
+	if len(bytes.TrimSpace(ra.buf)) > 0 {
+		ra.callback(ra.buf)
+	}
+	ra.buf = nil
+}
@@ -0,0 +1,69 @@
+package floop
+
+import (
+	"testing"
+
+	"github.com/d3sw/floop/types"
+)
+
+func testRecords(t *testing.T, conf *types.RecordConfig, writes ...string) []string {
+	var records []string
+	ra, err := newRecordAssembler(conf, func(b []byte) {
+		records = append(records, string(b))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, w := range writes {
+		ra.Write([]byte(w))
+	}
+	ra.Flush()
+
+	return records
+}
+
+func Test_RecordAssembler_Regex(t *testing.T) {
+	records := testRecords(t, &types.RecordConfig{Mode: "regex", End: "^progress="},
+		"frame=1\nfps=0.0\nprogress=continue\n",
+		"frame=2\n", "fps=24.0\n", "progress=end\n")
+
+	if len(records) != 2 {
+		t.Fatalf("records: %q", records)
+	}
+	if records[1] != "frame=2\nfps=24.0\nprogress=end\n" {
+		t.Fatalf("record: %q", records[1])
+	}
+
+	kvs := transformKeyValuePairs(records[0], "\n", "=")
+	if kvs["frame"] != "1" || kvs["progress"] != "continue" {
+		t.Fatalf("kv: %v", kvs)
+	}
+}
+
+func Test_RecordAssembler_Blank(t *testing.T) {
+	records := testRecords(t, &types.RecordConfig{Mode: "blank"},
+		"panic: foo\n", "goroutine 1\n\n", "\nnext\n")
+
+	if len(records) != 2 || records[0] != "panic: foo\ngoroutine 1\n" || records[1] != "next\n" {
+		t.Fatalf("records: %q", records)
+	}
+}
+
+func Test_RecordAssembler_JSON(t *testing.T) {
+	records := testRecords(t, &types.RecordConfig{Mode: "json"},
+		"{\n", "  \"msg\": \"a } b\",\n", "  \"list\": [1, 2]\n", "}\n", "plain\n")
+
+	if len(records) != 2 || records[1] != "plain\n" {
+		t.Fatalf("records: %q", records)
+	}
+	if records[0] != "{\n  \"msg\": \"a } b\",\n  \"list\": [1, 2]\n}\n" {
+		t.Fatalf("record: %q", records[0])
+	}
+}
+
+func Test_RecordAssembler_Invalid(t *testing.T) {
+	if _, err := newRecordAssembler(&types.RecordConfig{Mode: "regex"}, nil); err == nil {
+		t.Fatal("should fail without start or end")
+	}
+}
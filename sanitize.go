@@ -0,0 +1,70 @@
+package floop
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+
+	"github.com/d3sw/floop/types"
+)
+
+// Matches CSI, OSC and two character escape sequences
+var ansiRegex = regexp.MustCompile(`\x1b(\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)|[@-Z\\-_])`)
+
+// sanitizer cleans up a single line of child output
+type sanitizer struct {
+	stripANSI bool
+	decoder   *encoding.Decoder
+	base64    bool
+}
+
+// newSanitizer returns a sanitizer for the stream config or nil if there is nothing to apply
+func newSanitizer(conf *types.StreamSanitizeConfig) (*sanitizer, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	s := &sanitizer{stripANSI: conf.StripANSI, base64: conf.Base64}
+
+	if conf.Charset != "" && !strings.EqualFold(conf.Charset, "utf-8") {
+		enc, err := htmlindex.Get(conf.Charset)
+		if err != nil {
+			return nil, fmt.Errorf("charset unsupported: %s", conf.Charset)
+		}
+		s.decoder = enc.NewDecoder()
+	}
+
+	if !s.stripANSI && s.decoder == nil && !s.base64 {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// Sanitize returns the sanitized line.  The trailing new line if any is preserved.
+func (s *sanitizer) Sanitize(line []byte) []byte {
+	var eol []byte
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line, eol = line[:n-1], line[n-1:]
+	}
+
+	if s.stripANSI {
+		line = ansiRegex.ReplaceAll(line, nil)
+	}
+
+	if s.decoder != nil {
+		if b, err := s.decoder.Bytes(line); err == nil {
+			line = b
+		}
+	}
+
+	if s.base64 && !utf8.Valid(line) {
+		line = []byte(base64.StdEncoding.EncodeToString(line))
+	}
+
+	return append(line, eol...)
+}
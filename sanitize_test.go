@@ -0,0 +1,82 @@
+package floop
+
+import (
+	"testing"
+
+	"github.com/d3sw/floop/child"
+	"github.com/d3sw/floop/types"
+)
+
+func Test_Sanitizer(t *testing.T) {
+	s, err := newSanitizer(&types.StreamSanitizeConfig{StripANSI: true, Charset: "latin1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := s.Sanitize([]byte("\x1b[1;32mcaf\xe9\x1b[0m \x1b]0;title\x07done\n"))
+	if string(out) != "café done\n" {
+		t.Fatalf("sanitized: %q", out)
+	}
+}
+
+func Test_Sanitizer_Base64(t *testing.T) {
+	s, err := newSanitizer(&types.StreamSanitizeConfig{Base64: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out := s.Sanitize([]byte("ok\n")); string(out) != "ok\n" {
+		t.Fatalf("sanitized: %q", out)
+	}
+	if out := s.Sanitize([]byte("\xff\xfe\n")); string(out) != "//4=\n" {
+		t.Fatalf("sanitized: %q", out)
+	}
+}
+
+func Test_BufferedWriter_Sanitize(t *testing.T) {
+	var lines []string
+	wr := NewBufferedWriter(func(b []byte) { lines = append(lines, string(b)) }, true)
+	wr.sanitizer, _ = newSanitizer(&types.StreamSanitizeConfig{StripANSI: true})
+
+	wr.Write([]byte("\x1b[31mred"))
+	wr.Write([]byte("\x1b[0m\nnext"))
+	wr.Flush()
+
+	if len(lines) != 1 || lines[0] != "red\n" {
+		t.Fatalf("lines: %q", lines)
+	}
+	if string(wr.Bytes()) != "red\nnext" {
+		t.Fatalf("buffer: %q", wr.Bytes())
+	}
+}
+
+func Test_Floop_SanitizeTrailingEscape(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Command = "printf"
+	conf.Args = []string{`done\n\033[0m`}
+	conf.Quiet = true
+	conf.Sanitize.Stdout = &types.StreamSanitizeConfig{StripANSI: true}
+
+	flp, err := New(conf, &child.NewInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &testHandler{}
+	if err = flp.lifecycle.register(types.EventTypeCompleted, h, &types.HandlerConfig{Type: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = flp.Start(map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The trailing escape sanitizes to nothing
+	if code := flp.Wait(); code != 0 {
+		t.Fatalf("exit code %d", code)
+	}
+	if len(h.events) != 1 {
+		t.Fatalf("completed events: %d", len(h.events))
+	}
+	if out := h.events[0].Result.Stdout; string(out) != "done" {
+		t.Fatalf("stdout: %q", out)
+	}
+}
@@ -0,0 +1,151 @@
+package floop
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	dSecretsDir = "/run/secrets"
+	secretMask  = "******"
+)
+
+// loadSecrets reads each file in the directory as a secret keyed by the file name.  A missing
+// directory is not an error.
+func loadSecrets(dir string) (map[string]string, error) {
+	secrets := make(map[string]string)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return secrets, nil
+		}
+		return nil, err
+	}
+
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+
+		// Stat to follow symlinks as used by mounted secrets
+		path := filepath.Join(dir, f.Name())
+		fi, err := os.Stat(path)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		secrets[f.Name()] = strings.TrimRight(string(b), "\r\n")
+	}
+
+	return secrets, nil
+}
+
+// maskWriter replaces secret values before writing to the underlying writer
+type maskWriter struct {
+	mtx    sync.RWMutex
+	values [][]byte
+	wr     io.Writer
+}
+
+// Write writes the masked byte slice
+func (mw *maskWriter) Write(b []byte) (int, error) {
+	mw.mtx.RLock()
+	out := b
+	for _, v := range mw.values {
+		out = bytes.Replace(out, v, []byte(secretMask), -1)
+	}
+	mw.mtx.RUnlock()
+
+	if _, err := mw.wr.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (mw *maskWriter) add(secrets map[string]string) {
+	mw.mtx.Lock()
+	defer mw.mtx.Unlock()
+
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		for _, v := range secretForms(secret) {
+			if !mw.has(v) {
+				mw.values = append(mw.values, []byte(v))
+			}
+		}
+	}
+
+	// Longest first so secrets containing other secrets are fully masked
+	sort.Slice(mw.values, func(i, j int) bool {
+		return len(mw.values[i]) > len(mw.values[j])
+	})
+}
+
+// secretForms returns the secret along with the encodings it may be logged in e.g. in a JSON or
+// form body or the output of b64enc.  Base64 is only masked when the whole value is the secret.
+func secretForms(secret string) []string {
+	forms := []string{
+		secret,
+		url.QueryEscape(secret),
+		url.PathEscape(secret),
+		base64.StdEncoding.EncodeToString([]byte(secret)),
+		base64.URLEncoding.EncodeToString([]byte(secret)),
+		base64.RawStdEncoding.EncodeToString([]byte(secret)),
+		base64.RawURLEncoding.EncodeToString([]byte(secret)),
+	}
+	for _, escapeHTML := range []bool{true, false} {
+		buf := bytes.NewBuffer(nil)
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(escapeHTML)
+		if err := enc.Encode(secret); err == nil {
+			// Without the quotes as the secret may be part of a longer string
+			forms = append(forms, strings.Trim(strings.TrimSuffix(buf.String(), "\n"), `"`))
+		}
+	}
+	return forms
+}
+
+func (mw *maskWriter) has(v string) bool {
+	for _, val := range mw.values {
+		if string(val) == v {
+			return true
+		}
+	}
+	return false
+}
+
+var maskLogMtx sync.Mutex
+
+// maskLogOutput masks the secret values in all log output.  The log writer is only wrapped once.
+func maskLogOutput(secrets map[string]string) {
+	if len(secrets) == 0 {
+		return
+	}
+
+	maskLogMtx.Lock()
+	defer maskLogMtx.Unlock()
+
+	mw, ok := log.Writer().(*maskWriter)
+	if !ok {
+		mw = &maskWriter{wr: log.Writer()}
+		log.SetOutput(mw)
+	}
+	mw.add(secrets)
+}
@@ -0,0 +1,67 @@
+package floop
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_loadSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "floop-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "api_token"), []byte("s3cr3t\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, ".hidden"), []byte("hidden"), 0600)
+
+	secrets, err := loadSecrets(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 1 || secrets["api_token"] != "s3cr3t" {
+		t.Fatalf("secrets: %v", secrets)
+	}
+
+	if secrets, err = loadSecrets(filepath.Join(dir, "missing")); err != nil || len(secrets) != 0 {
+		t.Fatalf("missing dir: %v %v", secrets, err)
+	}
+}
+
+func Test_maskWriter(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	mw := &maskWriter{wr: buf}
+	mw.add(map[string]string{"a": "token", "b": "token-long"})
+
+	mw.Write([]byte("body='token-long token'"))
+	if buf.String() != "body='"+secretMask+" "+secretMask+"'" {
+		t.Fatalf("masked: %s", buf.String())
+	}
+}
+
+func Test_maskWriter_Encoded(t *testing.T) {
+	secret := `p@ss "word"&<x>/+`
+	buf := bytes.NewBuffer(nil)
+	mw := &maskWriter{wr: buf}
+	mw.add(map[string]string{"a": secret})
+
+	for _, enc := range []string{
+		url.QueryEscape(secret),
+		url.PathEscape(secret),
+		base64.StdEncoding.EncodeToString([]byte(secret)),
+		base64.RawURLEncoding.EncodeToString([]byte(secret)),
+		`p@ss \"word\"&<x>/+`,
+		`p@ss \"word\"\u0026\u003cx\u003e/+`,
+	} {
+		buf.Reset()
+		mw.Write([]byte("body='" + enc + "'"))
+		if buf.String() != "body='"+secretMask+"'" {
+			t.Fatalf("masked %s: %s", enc, buf.String())
+		}
+	}
+}
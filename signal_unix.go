@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package floop
+
+import (
+	"os"
+	"syscall"
+)
+
+// signals are the signals that may be sent to the child over the control channel
+var signals = map[string]os.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"CONT": syscall.SIGCONT,
+	"STOP": syscall.SIGSTOP,
+}
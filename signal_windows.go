@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package floop
+
+import "os"
+
+// signals are the signals that may be sent to the child over the control channel.  Windows only
+// supports killing the process.
+var signals = map[string]os.Signal{
+	"KILL": os.Kill,
+}
@@ -0,0 +1,220 @@
+package floop
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/persephony/shml"
+
+	"github.com/d3sw/floop/types"
+)
+
+const (
+	engineShml       = "shml"
+	engineGoTemplate = "gotemplate"
+)
+
+// handlerTemplate is a parsed template for a handler uri, body or option value
+type handlerTemplate interface {
+	Execute(data *templateData) (string, error)
+}
+
+// parseTemplate parses the text with the engine from the handler config.  An empty engine
+// defaults to shml.  Partials are only available to the gotemplate engine.
+func parseTemplate(conf *types.HandlerConfig, text string) (handlerTemplate, error) {
+	switch conf.Engine {
+	case "", engineShml:
+		tmpl := shml.New()
+		if err := tmpl.Parse([]byte(text)); err != nil {
+			return nil, err
+		}
+		return &shmlTemplate{tmpl: tmpl}, nil
+
+	case engineGoTemplate:
+		tmpl := template.New("").Funcs(templateFuncs)
+		for name, partial := range conf.Partials {
+			if _, err := tmpl.New(name).Parse(partial); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := tmpl.Parse(text); err != nil {
+			return nil, err
+		}
+		return &goTemplate{tmpl: tmpl}, nil
+	}
+
+	return nil, fmt.Errorf("template engine unsupported: %s", conf.Engine)
+}
+
+type shmlTemplate struct {
+	tmpl *shml.Template
+}
+
+func (t *shmlTemplate) Execute(data *templateData) (string, error) {
+	out, err := t.tmpl.Execute(data)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+type goTemplate struct {
+	tmpl *template.Template
+}
+
+func (t *goTemplate) Execute(data *templateData) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := t.tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// templateVars holds the process wide values available to handler templates
+type templateVars struct {
+	Env    map[string]string
+	Secret map[string]string
+}
+
+func newTemplateVars(secrets map[string]string) *templateVars {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if arr := strings.SplitN(kv, "=", 2); len(arr) == 2 {
+			env[arr[0]] = arr[1]
+		}
+	}
+
+	return &templateVars{Env: env, Secret: secrets}
+}
+
+// templateData is the data handler templates are executed against.  It contains the event fields
+// along with the environment and secrets.
+type templateData struct {
+	RunID     string
+	EventID   string
+	Seq       uint64
+	Type      types.EventType
+	Timestamp int64
+	Meta      map[string]interface{}
+	Data      interface{}
+	Env       map[string]string
+	Secret    map[string]string
+}
+
+func newTemplateData(event *types.Event, vars *templateVars) *templateData {
+	data := &templateData{
+		RunID:     event.RunID,
+		EventID:   event.ID,
+		Seq:       event.Seq,
+		Type:      event.Type,
+		Timestamp: event.Timestamp,
+		Meta:      event.Meta,
+		Data:      event.Data,
+	}
+	if vars != nil {
+		data.Env = vars.Env
+		data.Secret = vars.Secret
+	}
+	return data
+}
+
+// templateFuncs are the helper functions available to the gotemplate engine
+var templateFuncs = template.FuncMap{
+	"toJson":   tmplToJSON,
+	"default":  tmplDefault,
+	"upper":    func(v interface{}) string { return strings.ToUpper(toString(v)) },
+	"lower":    func(v interface{}) string { return strings.ToLower(toString(v)) },
+	"b64enc":   func(v interface{}) string { return base64.StdEncoding.EncodeToString([]byte(toString(v))) },
+	"sha256":   tmplSha256,
+	"now":      time.Now,
+	"duration": tmplDuration,
+	"truncate": tmplTruncate,
+	"indent":   tmplIndent,
+	"quote":    tmplQuote,
+}
+
+// jsonValue converts byte slices and child results to strings so they are not base64 encoded
+func jsonValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case []byte:
+		return string(val)
+	case *types.ChildResult:
+		return map[string]interface{}{
+			"Code":   val.Code,
+			"Stdout": string(val.Stdout),
+			"Stderr": string(val.Stderr),
+		}
+	}
+	return v
+}
+
+func tmplToJSON(v interface{}) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(jsonValue(v)); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// tmplQuote returns the value as a quoted and escaped JSON string
+func tmplQuote(v interface{}) (string, error) {
+	return tmplToJSON(toString(v))
+}
+
+// tmplDefault returns def if the value is empty
+func tmplDefault(def, v interface{}) interface{} {
+	if v == nil {
+		return def
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		if rv.Len() == 0 {
+			return def
+		}
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return def
+		}
+	}
+	return v
+}
+
+func tmplSha256(v interface{}) string {
+	sum := sha256.Sum256([]byte(toString(v)))
+	return hex.EncodeToString(sum[:])
+}
+
+// tmplDuration formats a number of seconds as a duration e.g. 1m30s
+func tmplDuration(v interface{}) (string, error) {
+	secs, ok := parseNumber(v)
+	if !ok {
+		return "", fmt.Errorf("duration: invalid number %v", v)
+	}
+	return time.Duration(secs * float64(time.Second)).String(), nil
+}
+
+func tmplTruncate(n int, v interface{}) string {
+	r := []rune(toString(v))
+	if n < 0 || len(r) <= n {
+		return string(r)
+	}
+	return string(r[:n])
+}
+
+func tmplIndent(n int, v interface{}) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.Replace(toString(v), "\n", "\n"+pad, -1)
+}
@@ -0,0 +1,60 @@
+package floop
+
+import (
+	"testing"
+
+	"github.com/d3sw/floop/types"
+)
+
+var goTemplateConf = &types.HandlerConfig{Engine: engineGoTemplate}
+
+func Test_GoTemplate(t *testing.T) {
+	tmpl, err := parseTemplate(goTemplateConf, `{"ref": {{ .Meta.refname | upper | quote }}, `+
+		`"task": {{ .Meta.taskId | default "none" | quote }}, "code": {{ .Data.Code }}, `+
+		`"message": {{ .Data.Stderr | truncate 11 | quote }}, "data": {{ toJson .Data }}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := newTemplateData(&types.Event{
+		Type: types.EventTypeFailed,
+		Meta: map[string]interface{}{"refname": "ref1"},
+		Data: &types.ChildResult{Code: 1, Stderr: []byte("bad \"input\"\nline 2")},
+	}, nil)
+
+	out, err := tmpl.Execute(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"ref": "REF1", "task": "none", "code": 1, "message": "bad \"input\"", ` +
+		`"data": {"Code":1,"Stderr":"bad \"input\"\nline 2","Stdout":""}}`
+	if out != expected {
+		t.Fatalf("\nexpected: %s\n     got: %s", expected, out)
+	}
+}
+
+func Test_GoTemplate_Funcs(t *testing.T) {
+	tmpl, err := parseTemplate(goTemplateConf,
+		`{{ b64enc "foo" }} {{ sha256 "foo" | truncate 8 }} {{ duration 90 }} {{ indent 2 "a\nb" }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := tmpl.Execute(newTemplateData(&types.Event{}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "Zm9v 2c26b46b 1m30s   a\n  b" {
+		t.Fatalf("got: %q", out)
+	}
+}
+
+func Test_parseTemplate_Invalid(t *testing.T) {
+	if _, err := parseTemplate(goTemplateConf, "{{ .Meta"); err == nil {
+		t.Fatal("should fail to parse")
+	}
+	if _, err := parseTemplate(&types.HandlerConfig{Engine: "mustache"}, ""); err == nil {
+		t.Fatal("should fail on unsupported engine")
+	}
+}
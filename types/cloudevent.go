@@ -0,0 +1,44 @@
+package types
+
+import "encoding/json"
+
+// CloudEventsSpecVersion is the CloudEvents spec version of the envelope
+const CloudEventsSpecVersion = "1.0"
+
+// CloudEvent is a CloudEvents envelope in structured content mode
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data,omitempty"`
+
+	// Extension attributes
+	RunID    string `json:"runid,omitempty"`
+	Sequence string `json:"sequence,omitempty"`
+}
+
+// Headers returns the attributes as HTTP headers for binary content mode
+func (ce *CloudEvent) Headers() map[string]string {
+	headers := map[string]string{
+		"ce-specversion": ce.SpecVersion,
+		"ce-id":          ce.ID,
+		"ce-source":      ce.Source,
+		"ce-type":        ce.Type,
+		"ce-time":        ce.Time,
+		"Content-Type":   ce.DataContentType,
+	}
+	if ce.Subject != "" {
+		headers["ce-subject"] = ce.Subject
+	}
+	if ce.RunID != "" {
+		headers["ce-runid"] = ce.RunID
+	}
+	if ce.Sequence != "" {
+		headers["ce-sequence"] = ce.Sequence
+	}
+	return headers
+}
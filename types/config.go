@@ -1,6 +1,10 @@
 package types
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
 
 type Options map[string]interface{}
 
@@ -14,6 +18,96 @@ func (opt Options) GetString(key string) (string, bool) {
 	return val, ok
 }
 
+// GetInt returns an integer option.  Numeric strings are also accepted.
+func (opt Options) GetInt(key string) (int, bool) {
+	v, ok := opt[key]
+	if !ok {
+		return 0, false
+	}
+
+	switch val := v.(type) {
+	case int:
+		return val, true
+	case int64:
+		return int(val), true
+	case float64:
+		return int(val), true
+	case string:
+		i, err := strconv.Atoi(val)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// GetBool returns a boolean option.  Strings accepted by strconv.ParseBool are also accepted.
+func (opt Options) GetBool(key string) (bool, bool) {
+	v, ok := opt[key]
+	if !ok {
+		return false, false
+	}
+
+	switch val := v.(type) {
+	case bool:
+		return val, true
+	case string:
+		b, err := strconv.ParseBool(val)
+		return b, err == nil
+	}
+	return false, false
+}
+
+// GetDuration returns a duration option.  Numbers are in seconds and strings may be either a
+// number of seconds or a duration e.g. 1m30s
+func (opt Options) GetDuration(key string) (time.Duration, bool) {
+	v, ok := opt[key]
+	if !ok {
+		return 0, false
+	}
+
+	switch val := v.(type) {
+	case int:
+		return time.Duration(val) * time.Second, true
+	case int64:
+		return time.Duration(val) * time.Second, true
+	case float64:
+		return time.Duration(val * float64(time.Second)), true
+	case string:
+		if secs, err := strconv.ParseFloat(val, 64); err == nil {
+			return time.Duration(secs * float64(time.Second)), true
+		}
+		d, err := time.ParseDuration(val)
+		return d, err == nil
+	}
+	return 0, false
+}
+
+// GetOptions returns a nested block of options
+func (opt Options) GetOptions(key string) (Options, bool) {
+	v, ok := opt[key]
+	if !ok {
+		return nil, false
+	}
+
+	switch val := v.(type) {
+	case Options:
+		return val, true
+	case map[string]interface{}:
+		return Options(val), true
+	case map[interface{}]interface{}:
+		out := make(Options, len(val))
+		for k, item := range val {
+			key, ok := k.(string)
+			if !ok {
+				return nil, false
+			}
+			out[key] = item
+		}
+		return out, true
+	}
+
+	return nil, false
+}
+
 // TransformConfig holds configs for a transform
 type TransformConfig []string
 
@@ -29,10 +123,35 @@ type HandlerConfig struct {
 	Context []string
 	// Body of the handler
 	Body string
+	// Template file for the body resolved relative to the config file.  Loaded into Body
+	BodyFile string `yaml:"body_file"`
+	// Shared partials by name available to the gotemplate engine.  Loaded from the config
+	Partials map[string]string `yaml:"-"`
+	// Template engine used for the uri, body and options: shml (default) or gotemplate
+	Engine string
+	// Payload format used when no body is given: cloudevents
+	Format string
 	// Handler specific configs
 	Options Options
 	// Continue running child process even it handler returns error
 	IgnoreErrors bool `yaml:"ignorerrors"`
+	// Percent-complete and ETA estimation applied to transformed progress events
+	Estimate *EstimateConfig
+	// Envelope built for the event when the format is cloudevents and no body is given.  Only
+	// set on the normalized config
+	CloudEvent *CloudEvent `yaml:"-"`
+}
+
+// EstimateConfig holds the config for estimating progress from numeric event data
+type EstimateConfig struct {
+	// Data key of the current value
+	Current string
+	// Data key or meta key of the total value.  A number may also be given directly
+	Total string
+	// Data key of a value in the form current/total.  Used in place of current and total
+	Ratio string
+	// Number of samples used for the moving average rate
+	Window int
 }
 
 // Clone clones an existing config
@@ -43,8 +162,14 @@ func (conf *HandlerConfig) Clone() *HandlerConfig {
 		Transform:    conf.Transform,
 		Context:      conf.Context,
 		Body:         conf.Body,
+		BodyFile:     conf.BodyFile,
+		Partials:     conf.Partials,
+		Engine:       conf.Engine,
+		Format:       conf.Format,
 		Options:      conf.Options,
 		IgnoreErrors: conf.IgnoreErrors,
+		Estimate:     conf.Estimate,
+		CloudEvent:   conf.CloudEvent,
 	}
 }
 
@@ -74,3 +199,122 @@ func (conf TransformConfig) ValidateTransform() (bool, error) {
 
 	return true, err
 }
+
+// RecordConfig holds the config for grouping multiple lines of output into a single progress
+// record
+type RecordConfig struct {
+	// Grouping mode: regex, blank or json
+	Mode string
+	// Regex matching the first line of a record.  Only used in regex mode
+	Start string
+	// Regex matching the last line of a record.  Only used in regex mode
+	End string
+}
+
+// Validate validates the record config
+func (conf *RecordConfig) Validate() error {
+	switch conf.Mode {
+	case "regex":
+		if conf.Start == "" && conf.End == "" {
+			return fmt.Errorf("record regex requires start or end")
+		}
+	case "blank", "json":
+	default:
+		return fmt.Errorf("record mode unsupported: %s", conf.Mode)
+	}
+	return nil
+}
+
+// SanitizeConfig holds the output sanitization config for stdout and stderr
+type SanitizeConfig struct {
+	Stdout *StreamSanitizeConfig
+	Stderr *StreamSanitizeConfig
+}
+
+// StreamSanitizeConfig holds the sanitization options for a single output stream
+type StreamSanitizeConfig struct {
+	// Remove ANSI/VT100 escape sequences
+	StripANSI bool `yaml:"strip_ansi"`
+	// Charset of the output converted to UTF-8 e.g. latin1, windows-1252
+	Charset string
+	// Base64 encode lines that are not valid UTF-8
+	Base64 bool
+}
+
+// Validate validates the estimate config
+func (conf *EstimateConfig) Validate() error {
+	if conf.Window < 0 {
+		return fmt.Errorf("estimate window invalid: %d", conf.Window)
+	}
+	if conf.Ratio == "" && (conf.Current == "" || conf.Total == "") {
+		return fmt.Errorf("estimate requires ratio or current and total")
+	}
+	return nil
+}
+
+// ControlConfig is the config for the remote control channel.  Commands are received on the topic
+// which may be templated e.g. floop.control.${Meta.refname}.  Options are the nats connection
+// options.
+type ControlConfig struct {
+	URI    string
+	Topic  string
+	Engine string
+	// Signal sent to the child by the reload command e.g. HUP.  Reload is not supported without
+	// it as restarting the child is not
+	ReloadSignal string `yaml:"reload_signal"`
+	Options      Options
+}
+
+// Validate validates the control config
+func (conf *ControlConfig) Validate() error {
+	if conf.URI == "" {
+		return fmt.Errorf("control uri required")
+	}
+	if conf.Topic == "" {
+		return fmt.Errorf("control topic required")
+	}
+	return nil
+}
+
+// WorkerConfig is the config for worker mode.  Jobs are received on the topic as a member of the
+// queue group.  With jetstream jobs are pulled from the durable consumer which defaults to the
+// queue name.  Options are the nats connection options.
+type WorkerConfig struct {
+	URI         string
+	Topic       string
+	Queue       string
+	Concurrency int
+	JetStream   bool
+	// Stream of the topic.  Optional as it is looked up by the topic
+	Stream  string
+	Durable string
+	// Seconds a job may go unacknowledged before it is redelivered.  In progress jobs are kept
+	// alive so it only needs to cover a worker going away.
+	AckWait int `yaml:"ack_wait"`
+	// Deliveries of a job before it is given up on.  -1 is unlimited
+	MaxDeliver int `yaml:"max_deliver"`
+	Options    Options
+}
+
+// Validate validates the worker config
+func (conf *WorkerConfig) Validate() error {
+	if conf.URI == "" {
+		return fmt.Errorf("worker uri required")
+	}
+	if conf.Topic == "" {
+		return fmt.Errorf("worker topic required")
+	}
+	if conf.Queue == "" && (!conf.JetStream || conf.Durable == "") {
+		return fmt.Errorf("worker queue required")
+	}
+	if conf.Concurrency < 0 {
+		return fmt.Errorf("invalid worker concurrency: %d", conf.Concurrency)
+	}
+	if conf.AckWait < 0 {
+		return fmt.Errorf("invalid worker ack_wait: %d", conf.AckWait)
+	}
+	if conf.MaxDeliver < -1 {
+		return fmt.Errorf("invalid worker max_deliver: %d", conf.MaxDeliver)
+	}
+	return nil
+}
@@ -12,10 +12,16 @@ const (
 )
 
 // Event is a single event in a given lifecycle.  Meta is the user passed in metadata.  The type
-// of data will be dependent on the event type.
+// of data will be dependent on the event type.  ID is unique per event and Seq is monotonic within
+// the run given by RunID.  Result is the full result of the child for the terminal events and is
+// not part of the payload.
 type Event struct {
+	ID        string                 `json:"id"`
+	RunID     string                 `json:"run_id"`
+	Seq       uint64                 `json:"seq"`
 	Type      EventType              `json:"type"`
 	Timestamp int64                  `json:"timestamp"`
 	Meta      map[string]interface{} `json:"meta"`
 	Data      interface{}            `json:"data"`
+	Result    *ChildResult           `json:"-"`
 }
@@ -0,0 +1,492 @@
+package floop
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/d3sw/floop/child"
+	"github.com/d3sw/floop/handlers"
+	"github.com/d3sw/floop/types"
+)
+
+var (
+	dWorkerConcurrency = 1
+	dWorkerAckWait     = 30 * time.Second
+	dWorkerMaxDeliver  = 5
+	// How long to wait for a job before checking whether the worker is stopping
+	dWorkerFetchWait = 2 * time.Second
+	// How long a job that failed to start is held before it is returned for redelivery
+	dWorkerRetryWait = 5 * time.Second
+)
+
+// Worker runs the command for each job received on a nats subject as a member of a queue group.
+// The job payload is a JSON object used as the meta of the run and is also the stdin of the
+// command.  Each job runs the full lifecycle after which it is acked.  With jetstream unfinished
+// jobs are redelivered to another worker.
+type Worker struct {
+	conf  *Config
+	wconf *types.WorkerConfig
+
+	conn *nats.Conn
+	js   nats.JetStreamContext
+
+	// Handlers and the control channel are connected once and shared by the jobs
+	lifecycle *Lifecycle
+	control   *controller
+
+	ackWait    time.Duration
+	maxDeliver int
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// workerReply is the reply to a core nats job request
+type workerReply struct {
+	RunID string `json:"run_id,omitempty"`
+	Code  int    `json:"code"`
+	Error string `json:"error,omitempty"`
+}
+
+// NewWorker validates the worker config and connects to nats
+func NewWorker(conf *Config) (*Worker, error) {
+	if conf.Worker == nil {
+		return nil, fmt.Errorf("worker config required")
+	}
+	wconf := conf.Worker
+	if err := wconf.Validate(); err != nil {
+		return nil, err
+	}
+
+	w := &Worker{conf: conf, wconf: wconf, ackWait: dWorkerAckWait, maxDeliver: dWorkerMaxDeliver,
+		stop: make(chan struct{})}
+	if wconf.AckWait > 0 {
+		w.ackWait = time.Duration(wconf.AckWait) * time.Second
+	}
+	if wconf.MaxDeliver != 0 {
+		w.maxDeliver = wconf.MaxDeliver
+	}
+
+	// Config errors would fail every job so they fail the worker instead
+	if _, err := exec.LookPath(conf.Command); err != nil {
+		return nil, err
+	}
+	if err := w.connectHandlers(); err != nil {
+		w.closeHandlers()
+		return nil, err
+	}
+
+	opts, err := renderOptions(&types.HandlerConfig{}, wconf.Options, nil, w.lifecycle.vars)
+	if err != nil {
+		w.closeHandlers()
+		return nil, fmt.Errorf("worker options: %v", err)
+	}
+	if w.conn, err = handlers.NatsConnect(wconf.URI, opts); err != nil {
+		w.closeHandlers()
+		return nil, err
+	}
+	if wconf.JetStream {
+		if w.js, err = w.conn.JetStream(); err != nil {
+			w.conn.Close()
+			w.closeHandlers()
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// connectHandlers loads the handlers and the control channel shared by the jobs and checks a run
+// can be set up
+func (w *Worker) connectHandlers() error {
+	// The connection of a templated client id is made on the first event so it cannot be shared
+	for _, configs := range w.conf.Handlers {
+		for _, hc := range configs {
+			if clientID, _ := hc.Options.GetString("client_id"); hc.Type == "nats-stream" && handlers.IsTemplated(clientID) {
+				return fmt.Errorf("nats-stream client_id cannot be templated in a worker: %s", clientID)
+			}
+		}
+	}
+
+	var err error
+	if w.lifecycle, err = NewLifecycle(w.conf); err != nil {
+		return err
+	}
+	if w.conf.Control != nil {
+		if w.control, err = newController(w.conf.Control, w.lifecycle.vars); err != nil {
+			return err
+		}
+	}
+
+	flp, err := w.newRun(&child.NewInput{})
+	if flp != nil {
+		flp.close()
+	}
+	return err
+}
+
+// closeHandlers closes the shared handlers and control channel
+func (w *Worker) closeHandlers() {
+	if w.lifecycle != nil {
+		w.lifecycle.Close()
+	}
+	if w.control != nil {
+		w.control.Close()
+	}
+}
+
+// newRun sets up a run of the command for a job
+func (w *Worker) newRun(input *child.NewInput) (*Floop, error) {
+	return newFloop(w.conf, w.lifecycle.newRun(), w.control, input)
+}
+
+// Run consumes jobs until the worker is stopped or receives SIGTERM or SIGINT.  Running jobs are
+// waited on.  Their children receive the same signal.
+func (w *Worker) Run() error {
+	defer w.closeHandlers()
+	defer w.conn.Close()
+
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signalChannel)
+	go func() {
+		select {
+		case sig := <-signalChannel:
+			log.Printf("[INFO] (floop) got \"%s\" signal.  Stopping worker\n", sig)
+			w.Stop()
+		case <-w.stop:
+		}
+	}()
+
+	concurrency := w.wconf.Concurrency
+	if concurrency == 0 {
+		concurrency = dWorkerConcurrency
+	}
+
+	if w.js == nil {
+		for i := 0; i < concurrency; i++ {
+			w.wg.Add(1)
+			go w.consumeQueue()
+		}
+		w.logStarted(concurrency)
+		w.wg.Wait()
+		return nil
+	}
+
+	// Each consumer pulls from its own subscription so it only takes a job when it is free
+	subs := make([]*nats.Subscription, 0, concurrency)
+	defer func() {
+		for _, sub := range subs {
+			sub.Unsubscribe()
+		}
+	}()
+	for i := 0; i < concurrency; i++ {
+		sub, err := w.subscribe()
+		if err != nil {
+			w.Stop()
+			w.wg.Wait()
+			return err
+		}
+		subs = append(subs, sub)
+		w.wg.Add(1)
+		go w.consume(sub)
+	}
+	w.logStarted(concurrency)
+
+	w.wg.Wait()
+	return nil
+}
+
+func (w *Worker) logStarted(concurrency int) {
+	log.Printf("[INFO] (floop) worker started topic=%s queue=%s concurrency=%d", w.wconf.Topic,
+		w.wconf.Queue, concurrency)
+}
+
+// Stop stops taking new jobs.  Run returns once the running jobs complete.
+func (w *Worker) Stop() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+func (w *Worker) stopping() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *Worker) subscribe() (*nats.Subscription, error) {
+	if w.js == nil {
+		// The server stops delivering to the subscription after one job so it only goes to free
+		// consumers
+		sub, err := w.conn.QueueSubscribeSync(w.wconf.Topic, w.wconf.Queue)
+		if err != nil {
+			return nil, err
+		}
+		if err = sub.AutoUnsubscribe(1); err != nil {
+			sub.Unsubscribe()
+			return nil, err
+		}
+		return sub, nil
+	}
+
+	durable := w.wconf.Durable
+	if durable == "" {
+		durable = w.wconf.Queue
+	}
+	opts := []nats.SubOpt{nats.ManualAck(), nats.MaxDeliver(w.maxDeliver)}
+	if w.wconf.AckWait > 0 {
+		opts = append(opts, nats.AckWait(w.ackWait))
+	}
+	if w.wconf.Stream != "" {
+		opts = append(opts, nats.BindStream(w.wconf.Stream))
+	}
+	return w.js.PullSubscribe(w.wconf.Topic, durable, opts...)
+}
+
+// next returns the next jetstream job or nats.ErrTimeout if there is none
+func (w *Worker) next(sub *nats.Subscription) (*nats.Msg, error) {
+	msgs, err := sub.Fetch(1, nats.MaxWait(dWorkerFetchWait))
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, nats.ErrTimeout
+	}
+	return msgs[0], nil
+}
+
+func (w *Worker) consume(sub *nats.Subscription) {
+	defer w.wg.Done()
+
+	for !w.stopping() {
+		msg, err := w.next(sub)
+		if err == nats.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			if !w.backoff(err) {
+				return
+			}
+			continue
+		}
+
+		w.process(msg)
+	}
+}
+
+// consumeQueue takes core nats jobs one at a time.  It is only a member of the queue group while
+// it waits for a job.
+func (w *Worker) consumeQueue() {
+	defer w.wg.Done()
+
+	var sub *nats.Subscription
+	for !w.stopping() {
+		var err error
+		if sub == nil {
+			if sub, err = w.subscribe(); err != nil {
+				if !w.backoff(err) {
+					return
+				}
+				continue
+			}
+		}
+
+		msg, err := sub.NextMsg(dWorkerFetchWait)
+		if err == nats.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			sub.Unsubscribe()
+			sub = nil
+			if !w.backoff(err) {
+				return
+			}
+			continue
+		}
+		sub = nil
+
+		w.process(msg)
+	}
+
+	if sub == nil {
+		return
+	}
+	// Core nats has no redelivery so a job received while stopping is replied to with an error
+	if err := sub.Drain(); err != nil {
+		sub.Unsubscribe()
+		return
+	}
+	if msg, err := sub.NextMsg(dWorkerFetchWait); err == nil {
+		w.respond(msg, &workerReply{Code: -1, Error: "worker stopped"})
+	}
+}
+
+// backoff logs the consumer error and waits so a lost connection does not spin.  It returns false
+// if the consumer cannot continue.
+func (w *Worker) backoff(err error) bool {
+	log.Printf("[ERROR] (floop) worker topic=%s %v", w.wconf.Topic, err)
+	if err == nats.ErrConnectionClosed || err == nats.ErrBadSubscription {
+		return false
+	}
+	select {
+	case <-w.stop:
+	case <-time.After(dWorkerFetchWait):
+	}
+	return true
+}
+
+// process runs the job.  Invalid jobs and jobs whose command cannot be run are terminated.  Jobs
+// that fail to start otherwise e.g. a handler is unavailable are redelivered after a short wait and
+// jobs interrupted by the worker stopping are redelivered immediately.
+func (w *Worker) process(msg *nats.Msg) {
+	meta := make(map[string]interface{})
+	if err := json.Unmarshal(msg.Data, &meta); err != nil {
+		w.reject(msg, fmt.Errorf("invalid job: %v", err))
+		return
+	}
+	if !w.conf.HasMeta(meta) {
+		w.reject(msg, fmt.Errorf("required metadata: %v", w.conf.Meta))
+		return
+	}
+
+	if w.js != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go w.keepAlive(msg, done)
+	}
+
+	flp, err := w.newRun(&child.NewInput{Stdin: bytes.NewReader(msg.Data)})
+	if err != nil {
+		if flp != nil {
+			flp.close()
+		}
+		w.retry(msg, err)
+		return
+	}
+	runID := flp.lifecycle.RunID()
+	log.Printf("[INFO] (floop) worker job run_id=%s", runID)
+
+	if err = flp.Start(meta); err != nil {
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+			w.reject(msg, fmt.Errorf("run_id=%s %v", runID, err))
+		} else {
+			w.retry(msg, fmt.Errorf("run_id=%s %v", runID, err))
+		}
+		return
+	}
+	code := flp.Wait()
+
+	if code != 0 && w.stopping() {
+		w.requeue(msg, fmt.Errorf("run_id=%s interrupted code=%d", runID, code))
+		return
+	}
+	w.ack(msg, &workerReply{RunID: runID, Code: code})
+}
+
+// keepAlive keeps the jetstream job from being redelivered while it runs
+func (w *Worker) keepAlive(msg *nats.Msg, done chan struct{}) {
+	ticker := time.NewTicker(w.ackWait / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := msg.InProgress(); err != nil {
+				log.Printf("[ERROR] (floop) worker in progress: %v", err)
+			}
+		}
+	}
+}
+
+func (w *Worker) ack(msg *nats.Msg, reply *workerReply) {
+	var err error
+	if w.js != nil {
+		err = msg.Ack()
+	} else {
+		err = w.respond(msg, reply)
+	}
+	if err != nil {
+		log.Printf("[ERROR] (floop) worker ack run_id=%s: %v", reply.RunID, err)
+	}
+}
+
+// reject drops a job that can never run
+func (w *Worker) reject(msg *nats.Msg, jobErr error) {
+	log.Printf("[ERROR] (floop) worker %v", jobErr)
+
+	var err error
+	if w.js != nil {
+		err = msg.Term()
+	} else {
+		err = w.respond(msg, &workerReply{Code: -1, Error: jobErr.Error()})
+	}
+	if err != nil {
+		log.Printf("[ERROR] (floop) worker reject: %v", err)
+	}
+}
+
+// retry returns the job for redelivery after a short wait so a failing worker does not spin through
+// max_deliver.  Core nats has no redelivery so the requester is told of the error.
+func (w *Worker) retry(msg *nats.Msg, jobErr error) {
+	log.Printf("[ERROR] (floop) worker %v", jobErr)
+
+	if w.js == nil {
+		if err := w.respond(msg, &workerReply{Code: -1, Error: jobErr.Error()}); err != nil {
+			log.Printf("[ERROR] (floop) worker retry: %v", err)
+		}
+		return
+	}
+
+	if meta, err := msg.Metadata(); err == nil && w.maxDeliver > 0 && int(meta.NumDelivered) >= w.maxDeliver {
+		log.Printf("[ERROR] (floop) worker giving up on job after %d deliveries", meta.NumDelivered)
+	}
+	select {
+	case <-w.stop:
+	case <-time.After(dWorkerRetryWait):
+	}
+	if err := msg.Nak(); err != nil {
+		log.Printf("[ERROR] (floop) worker retry: %v", err)
+	}
+}
+
+// requeue returns the job for immediate redelivery to another worker
+func (w *Worker) requeue(msg *nats.Msg, jobErr error) {
+	log.Printf("[ERROR] (floop) worker %v", jobErr)
+
+	var err error
+	if w.js != nil {
+		err = msg.Nak()
+	} else {
+		err = w.respond(msg, &workerReply{Code: -1, Error: jobErr.Error()})
+	}
+	if err != nil {
+		log.Printf("[ERROR] (floop) worker requeue: %v", err)
+	}
+}
+
+func (w *Worker) respond(msg *nats.Msg, reply *workerReply) error {
+	if msg.Reply == "" {
+		return nil
+	}
+	b, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	return msg.Respond(b)
+}
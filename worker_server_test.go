@@ -0,0 +1,203 @@
+//go:build nats
+// +build nats
+
+package floop
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/d3sw/floop/internal/natstest"
+	"github.com/d3sw/floop/types"
+)
+
+// startWorker runs the worker returning a channel with the result of Run
+func startWorker(t *testing.T, conf *Config) (*Worker, chan error) {
+	w, err := NewWorker(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- w.Run() }()
+	return w, done
+}
+
+func stopWorker(t *testing.T, w *Worker, done chan error) {
+	w.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("worker did not stop")
+	}
+}
+
+func Test_Worker(t *testing.T) {
+	s, shutdown := natstest.RunServer(t)
+	defer shutdown()
+
+	conf := DefaultConfig()
+	conf.Command = "sh"
+	conf.Args = []string{"-c", "grep -q fail && exit 3 || exit 0"}
+	conf.Quiet = true
+	conf.Meta = []string{"refname"}
+	conf.Worker = &types.WorkerConfig{URI: s.ClientURL(), Topic: "floop.jobs", Queue: "workers", Concurrency: 2}
+
+	w, done := startWorker(t, conf)
+	defer stopWorker(t, w, done)
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	request := func(payload string) *workerReply {
+		var msg *nats.Msg
+		for i := 0; i < 50; i++ {
+			// No responders until the worker subscribes
+			if msg, err = nc.Request("floop.jobs", []byte(payload), 5*time.Second); err != nats.ErrNoResponders {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reply workerReply
+		if err = json.Unmarshal(msg.Data, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return &reply
+	}
+
+	reply := request(`{"refname": "ok"}`)
+	if reply.Code != 0 || reply.RunID == "" || reply.Error != "" {
+		t.Fatalf("%+v", reply)
+	}
+	// Payload is the stdin of the command
+	if reply = request(`{"refname": "fail"}`); reply.Code != 3 {
+		t.Fatalf("%+v", reply)
+	}
+	if reply = request(`{"name": "ok"}`); reply.Code != -1 || reply.Error == "" {
+		t.Fatalf("%+v", reply)
+	}
+	if reply = request(`not json`); reply.Code != -1 || reply.Error == "" {
+		t.Fatalf("%+v", reply)
+	}
+}
+
+func Test_Worker_JetStream(t *testing.T) {
+	s, shutdown := natstest.RunServer(t)
+	defer shutdown()
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = js.AddStream(&nats.StreamConfig{Name: "JOBS", Subjects: []string{"floop.jobs"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{`{"refname": "a"}`, `{"refname": "b"}`, `not json`} {
+		if _, err = js.Publish("floop.jobs", []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf := DefaultConfig()
+	conf.Command = "true"
+	conf.Quiet = true
+	conf.Worker = &types.WorkerConfig{
+		URI:         s.ClientURL(),
+		Topic:       "floop.jobs",
+		Queue:       "workers",
+		Concurrency: 2,
+		JetStream:   true,
+		Stream:      "JOBS",
+	}
+
+	w, done := startWorker(t, conf)
+	defer stopWorker(t, w, done)
+
+	// All jobs are acked or terminated
+	for i := 0; ; i++ {
+		info, err := js.ConsumerInfo("JOBS", "workers")
+		if err == nil && info.Delivered.Stream == 3 && info.NumPending == 0 && info.NumAckPending == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("jobs not acked: %+v %v", info, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func Test_Worker_Busy(t *testing.T) {
+	s, shutdown := natstest.RunServer(t)
+	defer shutdown()
+
+	conf := DefaultConfig()
+	conf.Command = "sleep"
+	conf.Args = []string{"1"}
+	conf.Quiet = true
+	conf.Worker = &types.WorkerConfig{URI: s.ClientURL(), Topic: "floop.jobs", Queue: "workers"}
+
+	w, done := startWorker(t, conf)
+	defer stopWorker(t, w, done)
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	// Wait for the worker to subscribe
+	for i := 0; ; i++ {
+		if _, err = nc.Request("floop.jobs", []byte(`{}`), 5*time.Second); err != nats.ErrNoResponders {
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A busy worker leaves the queue group so jobs are not held behind the running one
+	inbox := nats.NewInbox()
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = nc.PublishRequest("floop.jobs", inbox, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err = nc.Request("floop.jobs", []byte(`{}`), 5*time.Second); err != nats.ErrNoResponders {
+		t.Fatalf("busy worker took a job: %v", err)
+	}
+
+	msg, err := sub.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply workerReply
+	if err = json.Unmarshal(msg.Data, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Code != 0 {
+		t.Fatalf("%+v", reply)
+	}
+}
@@ -0,0 +1,37 @@
+package floop
+
+import (
+	"testing"
+
+	"github.com/d3sw/floop/types"
+)
+
+func Test_NewWorker_Config(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Command = "floop-no-such-command"
+	conf.Worker = &types.WorkerConfig{URI: "nats://127.0.0.1:1", Topic: "floop.jobs", Queue: "workers"}
+
+	// Fail before connecting rather than on every job
+	if _, err := NewWorker(conf); err == nil {
+		t.Fatal("missing command should fail")
+	}
+
+	conf.Command = "true"
+	conf.Sanitize.Stdout = &types.StreamSanitizeConfig{Charset: "floop-no-such-charset"}
+	if _, err := NewWorker(conf); err == nil {
+		t.Fatal("invalid sanitizer should fail")
+	}
+
+	conf.Sanitize.Stdout = nil
+	conf.Handlers = map[types.EventType][]*types.HandlerConfig{types.EventTypeCompleted: {{Type: "nats-stream",
+		Options: types.Options{"cluster_id": "test-cluster", "client_id": "floop-${RunID}"}}}}
+	if _, err := NewWorker(conf); err == nil {
+		t.Fatal("templated client id should fail")
+	}
+
+	conf.Handlers = nil
+	conf.Worker.MaxDeliver = -2
+	if _, err := NewWorker(conf); err == nil {
+		t.Fatal("invalid max_deliver should fail")
+	}
+}
@@ -9,6 +9,9 @@ import (
 type BufferedWriter struct {
 	buffer *bytes.Buffer // complete buffer if enabled
 	wr     io.Writer
+
+	sanitizer *sanitizer // applied line by line if set
+	pending   []byte     // incomplete line waiting to be sanitized
 }
 
 // NewBufferedWriter instantiates a new BufferedWriter.  The cb is called each time a wrie ending in
@@ -40,9 +43,50 @@ func (wr *BufferedWriter) Bytes() []byte {
 	return wr.buffer.Bytes()
 }
 
-// Write writes the byte slice using the configured writer function
+// Write writes the byte slice using the configured writer function.  If a sanitizer is set only
+// complete lines are written and the remainder is held till the next write or flush.
 func (wr *BufferedWriter) Write(b []byte) (int, error) {
-	return wr.wr.Write(b)
+	if wr.sanitizer == nil {
+		return wr.wr.Write(b)
+	}
+
+	wr.pending = append(wr.pending, b...)
+	i := bytes.LastIndexByte(wr.pending, '\n')
+	if i < 0 {
+		return len(b), nil
+	}
+
+	var out []byte
+	for _, line := range bytes.SplitAfter(wr.pending[:i+1], []byte{'\n'}) {
+		if len(line) > 0 {
+			out = append(out, wr.sanitizer.Sanitize(line)...)
+		}
+	}
+	wr.pending = append([]byte{}, wr.pending[i+1:]...)
+
+	// Lines may sanitize to nothing
+	if len(out) == 0 {
+		return len(b), nil
+	}
+	if _, err := wr.wr.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush writes any incomplete line held by the sanitizer
+func (wr *BufferedWriter) Flush() error {
+	if len(wr.pending) == 0 {
+		return nil
+	}
+
+	line := wr.sanitizer.Sanitize(wr.pending)
+	wr.pending = nil
+	if len(line) == 0 {
+		return nil
+	}
+	_, err := wr.wr.Write(line)
+	return err
 }
 
 func newCallbackWriter(cb func([]byte), delim byte) *callbackWriter {
@@ -67,6 +111,10 @@ type callbackWriter struct {
 // write writes bytes to be parsed/analyzed.  The buffer is flushed only if the byte slice ends
 // in a new line.
 func (wr *callbackWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
 	// Flush and issue callback
 	if b[len(b)-1] == wr.delim {
 		wr.callback(append(wr.buf, b...))